@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/festeh/llm_flow/lsp"
+	"github.com/festeh/llm_flow/lsp/provider"
+)
+
+// Result is the outcome of one sample
+type Result struct {
+	Sample
+	Got        string  `json:"got"`
+	Exact      bool    `json:"exact"`
+	Similarity float64 `json:"similarity"`
+	Parses     *bool   `json:"parses,omitempty"`
+	LatencyMs  int64   `json:"latency_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// ModeSummary aggregates results of one masking mode
+type ModeSummary struct {
+	Samples       int     `json:"samples"`
+	Errors        int     `json:"errors"`
+	ExactMatch    float64 `json:"exact_match"`
+	EditSimilar   float64 `json:"edit_similarity"`
+	ParseChecked  int     `json:"parse_checked"`
+	ParseSuccess  float64 `json:"parse_success"`
+	AvgLatencyMs  int64   `json:"avg_latency_ms"`
+	totalLatency  int64
+	exactCount    int
+	parseOK       int
+	similaritySum float64
+}
+
+type Report struct {
+	Repo     string                  `json:"repo"`
+	Provider string                  `json:"provider"`
+	Model    string                  `json:"model"`
+	Seed     int64                   `json:"seed"`
+	Modes    map[string]*ModeSummary `json:"modes"`
+	Results  []Result                `json:"results"`
+}
+
+func main() {
+	repo := flag.String("repo", ".", "Repository to sample files from")
+	n := flag.Int("n", 20, "Samples per mode")
+	modesFlag := flag.String("modes", "line,multiline,function", "Comma separated masking modes")
+	seed := flag.Int64("seed", 1, "Random seed for sampling")
+	providerName := flag.String("provider", "codestral", "Provider to evaluate")
+	model := flag.String("model", "codestral-latest", "Model to evaluate")
+	endpoint := flag.String("endpoint", "", "Override the provider endpoint")
+	keySpec := flag.String("key", "", "Credential source for the API key, e.g. \"cmd:pass show codestral\"")
+	standin := flag.Bool("standin", false, "Run against a local stand-in server instead of the provider")
+	timeout := flag.Duration("timeout", 30*time.Second, "Timeout per sample")
+	out := flag.String("out", "eval_report.json", "Where to write the JSON report")
+	flag.Parse()
+
+	root, err := filepath.Abs(*repo)
+	if err != nil {
+		log.Fatalf("Invalid repo: %v", err)
+	}
+	files, err := collectFiles(root)
+	if err != nil {
+		log.Fatalf("Failed to collect files: %v", err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("No Go, Python or Lua files found in %s", root)
+	}
+	modes := strings.Split(*modesFlag, ",")
+	samples := drawSamples(files, modes, *n, rand.New(rand.NewSource(*seed)))
+
+	if *standin {
+		srv := newStandIn(samples)
+		defer srv.Close()
+		*providerName = "codestral"
+		*endpoint = srv.URL
+		if os.Getenv("CODESTRAL_API_KEY") == "" {
+			os.Setenv("CODESTRAL_API_KEY", "standin")
+		}
+	}
+	p, err := provider.NewProvider(*providerName, *model, *keySpec)
+	if err != nil {
+		log.Fatalf("Failed to create provider: %v", err)
+	}
+	server := lsp.NewServer(io.Discard)
+	server.SetProvider(root, provider.WithEndpoint(p, *endpoint, ""), *model)
+
+	report := Report{
+		Repo:     root,
+		Provider: *providerName,
+		Model:    *model,
+		Seed:     *seed,
+		Modes:    make(map[string]*ModeSummary),
+	}
+	for i, sample := range samples {
+		res := evaluate(server, sample, *timeout)
+		report.Results = append(report.Results, res)
+		report.add(res)
+		fmt.Fprintf(os.Stderr, "\r%d/%d", i+1, len(samples))
+	}
+	fmt.Fprintln(os.Stderr)
+	report.finish()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to marshal report: %v", err)
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+	report.print(os.Stdout)
+	fmt.Printf("Report written to %s\n", *out)
+}
+
+func evaluate(server *lsp.Server, sample Sample, timeout time.Duration) Result {
+	res := Result{Sample: sample}
+	uri := (&url.URL{Scheme: "file", Path: sample.File}).String()
+	server.TextDocumentDidOpen(context.Background(), &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: sample.Language, Text: sample.Masked()},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	mode := lsp.ModeLine
+	if sample.Mode != ModeLine {
+		mode = lsp.ModeBlock
+	}
+	got, err := server.PredictEditor(ctx, io.Discard, lsp.PredictEditorParams{URI: uri, Line: sample.Line, Pos: sample.Pos, Mode: mode})
+	res.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Got = got
+	res.Exact = exactMatch(sample.Expected, got)
+	res.Similarity = editSimilarity(sample.Expected, got)
+	// Only judge syntax when the untouched file is valid to begin with
+	if valid, ok := parses(sample.Language, sample.Prefix+sample.Expected+sample.Suffix); ok && valid {
+		valid, _ = parses(sample.Language, sample.Prefix+got+sample.Suffix)
+		res.Parses = &valid
+	}
+	return res
+}
+
+func (r *Report) add(res Result) {
+	m, ok := r.Modes[res.Mode]
+	if !ok {
+		m = &ModeSummary{}
+		r.Modes[res.Mode] = m
+	}
+	m.Samples++
+	m.totalLatency += res.LatencyMs
+	if res.Error != "" {
+		m.Errors++
+		return
+	}
+	if res.Exact {
+		m.exactCount++
+	}
+	m.similaritySum += res.Similarity
+	if res.Parses != nil {
+		m.ParseChecked++
+		if *res.Parses {
+			m.parseOK++
+		}
+	}
+}
+
+func (r *Report) finish() {
+	for _, m := range r.Modes {
+		if m.Samples == 0 {
+			continue
+		}
+		m.AvgLatencyMs = m.totalLatency / int64(m.Samples)
+		if scored := m.Samples - m.Errors; scored > 0 {
+			m.ExactMatch = float64(m.exactCount) / float64(scored)
+			m.EditSimilar = m.similaritySum / float64(scored)
+		}
+		if m.ParseChecked > 0 {
+			m.ParseSuccess = float64(m.parseOK) / float64(m.ParseChecked)
+		}
+	}
+}
+
+func (r *Report) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tSAMPLES\tERRORS\tEXACT\tEDIT SIM\tPARSES\tAVG LATENCY")
+	for _, mode := range []string{ModeLine, ModeMultiline, ModeFunction} {
+		m, ok := r.Modes[mode]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%.3f\t%.1f%% (%d)\t%dms\n",
+			mode, m.Samples, m.Errors, m.ExactMatch*100, m.EditSimilar,
+			m.ParseSuccess*100, m.ParseChecked, m.AvgLatencyMs)
+	}
+	tw.Flush()
+}
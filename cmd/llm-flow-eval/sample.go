@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Masking modes
+const (
+	ModeLine      = "line"
+	ModeMultiline = "multiline"
+	ModeFunction  = "function"
+)
+
+var languages = map[string]string{
+	".go":  "go",
+	".py":  "python",
+	".lua": "lua",
+}
+
+var skipDirs = map[string]bool{
+	".git":         true,
+	"vendor":       true,
+	"node_modules": true,
+	".venv":        true,
+	"__pycache__":  true,
+}
+
+// Sample is a document with a masked span the model has to fill in
+type Sample struct {
+	File     string `json:"file"`
+	Language string `json:"language"`
+	Mode     string `json:"mode"`
+	Line     int    `json:"line"`
+	Pos      int    `json:"pos"`
+	Prefix   string `json:"-"`
+	Suffix   string `json:"-"`
+	Expected string `json:"expected"`
+}
+
+func (s Sample) Masked() string {
+	return s.Prefix + s.Suffix
+}
+
+type sourceFile struct {
+	path     string
+	language string
+	lines    []string
+}
+
+func collectFiles(repo string) ([]sourceFile, error) {
+	var files []sourceFile
+	err := filepath.WalkDir(repo, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if skipDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		lang, ok := languages[filepath.Ext(path)]
+		if !ok {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{path: path, language: lang, lines: strings.Split(string(content), "\n")})
+		return nil
+	})
+	return files, err
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// maskSpan cuts lines[line][pos:] through the end of lines[last] out of the file
+func (f sourceFile) maskSpan(mode string, line, pos, last int) Sample {
+	prefix := strings.Join(f.lines[:line], "\n")
+	if line > 0 {
+		prefix += "\n"
+	}
+	prefix += f.lines[line][:pos]
+
+	expected := f.lines[line][pos:]
+	if last > line {
+		expected += "\n" + strings.Join(f.lines[line+1:last+1], "\n")
+	}
+
+	suffix := ""
+	if last < len(f.lines)-1 {
+		suffix = "\n" + strings.Join(f.lines[last+1:], "\n")
+	}
+	return Sample{
+		File:     f.path,
+		Language: f.language,
+		Mode:     mode,
+		Line:     line,
+		Pos:      pos,
+		Prefix:   prefix,
+		Suffix:   suffix,
+		Expected: expected,
+	}
+}
+
+func (f sourceFile) sampleLine(rng *rand.Rand, mode string) (Sample, bool) {
+	var candidates []int
+	for i, l := range f.lines {
+		if len(strings.TrimSpace(l)) > 3 {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return Sample{}, false
+	}
+	line := candidates[rng.Intn(len(candidates))]
+	last := line
+	if mode == ModeMultiline {
+		last = min(line+1+rng.Intn(4), len(f.lines)-1)
+	}
+	return f.maskSpan(mode, line, indentOf(f.lines[line]), last), true
+}
+
+// functionBodies returns [first, last] line ranges of function bodies
+func (f sourceFile) functionBodies() [][2]int {
+	var bodies [][2]int
+	for i, l := range f.lines {
+		trimmed := strings.TrimSpace(l)
+		indent := indentOf(l)
+		var isHeader bool
+		switch f.language {
+		case "go":
+			isHeader = strings.HasPrefix(trimmed, "func ") && strings.HasSuffix(trimmed, "{")
+		case "python":
+			isHeader = (strings.HasPrefix(trimmed, "def ") || strings.HasPrefix(trimmed, "async def ")) && strings.HasSuffix(trimmed, ":")
+		case "lua":
+			isHeader = strings.Contains(trimmed, "function") && strings.HasSuffix(trimmed, ")")
+		}
+		if !isHeader {
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(f.lines); j++ {
+			t := strings.TrimSpace(f.lines[j])
+			if t == "" {
+				continue
+			}
+			if f.language == "python" {
+				if indentOf(f.lines[j]) <= indent {
+					end = j
+					break
+				}
+				continue
+			}
+			closer := "}"
+			if f.language == "lua" {
+				closer = "end"
+			}
+			if indentOf(f.lines[j]) == indent && strings.HasPrefix(t, closer) {
+				end = j
+				break
+			}
+		}
+		if f.language == "python" && end == -1 {
+			end = len(f.lines)
+		}
+		// Body is everything strictly between header and closer
+		last := end - 1
+		for last > i && strings.TrimSpace(f.lines[last]) == "" {
+			last--
+		}
+		if end > 0 && last > i {
+			bodies = append(bodies, [2]int{i + 1, last})
+		}
+	}
+	return bodies
+}
+
+func (f sourceFile) sampleFunction(rng *rand.Rand) (Sample, bool) {
+	bodies := f.functionBodies()
+	if len(bodies) == 0 {
+		return Sample{}, false
+	}
+	body := bodies[rng.Intn(len(bodies))]
+	first := body[0]
+	return f.maskSpan(ModeFunction, first, indentOf(f.lines[first]), body[1]), true
+}
+
+// drawSamples picks n samples per mode from random files
+func drawSamples(files []sourceFile, modes []string, n int, rng *rand.Rand) []Sample {
+	var samples []Sample
+	for _, mode := range modes {
+		for attempts, got := 0, 0; got < n && attempts < n*20; attempts++ {
+			f := files[rng.Intn(len(files))]
+			var s Sample
+			var ok bool
+			if mode == ModeFunction {
+				s, ok = f.sampleFunction(rng)
+			} else {
+				s, ok = f.sampleLine(rng, mode)
+			}
+			if ok && strings.TrimSpace(s.Expected) != "" {
+				samples = append(samples, s)
+				got++
+			}
+		}
+	}
+	return samples
+}
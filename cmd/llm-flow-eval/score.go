@@ -0,0 +1,61 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"os/exec"
+	"strings"
+)
+
+// editSimilarity is 1 - levenshtein(a, b) / max(len(a), len(b)) over runes
+func editSimilarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+func exactMatch(expected, got string) bool {
+	return strings.TrimRight(expected, " \t\n") == strings.TrimRight(got, " \t\n")
+}
+
+// parses reports whether source is syntactically valid. ok is false when no
+// checker is available for the language.
+func parses(language, source string) (valid bool, ok bool) {
+	switch language {
+	case "go":
+		_, err := parser.ParseFile(token.NewFileSet(), "", source, parser.AllErrors)
+		return err == nil, true
+	case "python":
+		return runChecker(source, "python3", "-c", "import ast, sys; ast.parse(sys.stdin.read())")
+	case "lua":
+		return runChecker(source, "luac", "-p", "-")
+	}
+	return false, false
+}
+
+func runChecker(source string, name string, args ...string) (bool, bool) {
+	if _, err := exec.LookPath(name); err != nil {
+		return false, false
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(source)
+	return cmd.Run() == nil, true
+}
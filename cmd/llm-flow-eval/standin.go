@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/festeh/llm_flow/lsp/provider/fake"
+)
+
+// newStandIn starts a local Codestral-compatible server that knows the masked
+// spans. It answers with the expected completion when the request carries
+// exactly the prefix and suffix of a sample, so it checks the whole pipeline
+// without network access.
+func newStandIn(samples []Sample) *fake.Server {
+	expected := make(map[string]string)
+	for _, sample := range samples {
+		expected[sample.Prefix+"\x00"+sample.Suffix] = sample.Expected
+	}
+	return fake.NewServer(fake.Options{
+		Format: fake.Codestral,
+		Complete: func(body map[string]interface{}) string {
+			prefix, _ := body["prefix"].(string)
+			suffix, _ := body["suffix"].(string)
+			return expected[prefix+"\x00"+suffix]
+		},
+	})
+}
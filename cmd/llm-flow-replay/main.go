@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/festeh/llm_flow/lsp"
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/record"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// mockBackend answers every request with the recorded raw response of the
+// entry currently being replayed
+type mockBackend struct {
+	mu       sync.Mutex
+	response string
+}
+
+func (m *mockBackend) set(response string) {
+	m.mu.Lock()
+	m.response = response
+	m.mu.Unlock()
+}
+
+func (m *mockBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	m.mu.Lock()
+	response := m.response
+	m.mu.Unlock()
+	if strings.HasPrefix(response, "data: ") {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	io.WriteString(w, response)
+}
+
+func main() {
+	file := flag.String("file", "", "Recording written by lsp-server -record")
+	providerName := flag.String("provider", "", "Provider to replay against (defaults to the recorded one)")
+	model := flag.String("model", "", "Model to replay against (defaults to the recorded one)")
+	endpoint := flag.String("endpoint", "", "Override the provider endpoint")
+	keySpec := flag.String("key", "", "Credential source for the API key, e.g. \"cmd:pass show codestral\"")
+	mock := flag.Bool("mock", false, "Serve recorded responses from a local HTTP server instead of calling the provider")
+	verbose := flag.Bool("v", false, "Print recorded and replayed results that differ")
+	flag.Parse()
+
+	if *file == "" {
+		log.Fatalf("-file is required")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Failed to open recording: %v", err)
+	}
+	entries, err := record.Read(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Failed to read recording: %v", err)
+	}
+
+	var backend *mockBackend
+	if *mock {
+		backend = &mockBackend{}
+		srv := httptest.NewServer(backend)
+		defer srv.Close()
+		*endpoint = srv.URL
+		// Providers refuse to start without a key, which the mock doesn't check
+		for _, env := range []string{"CODESTRAL_API_KEY", "HF_API_TOKEN", "NEBIUS_API_KEY"} {
+			if os.Getenv(env) == "" {
+				os.Setenv(env, "replay")
+			}
+		}
+	}
+
+	var matched, failed int
+	var recordedTotal, replayedTotal time.Duration
+	for i, e := range entries {
+		name := *providerName
+		if name == "" {
+			name = strings.ToLower(e.Provider)
+		}
+		m := *model
+		if m == "" {
+			m = e.Model
+		}
+		p, err := provider.NewProvider(name, m, *keySpec)
+		if err != nil {
+			log.Fatalf("Failed to create provider %s: %v", name, err)
+		}
+		// Chat flows such as rewrites are replayed with the conversation
+		// they sent, which the context alone does not give
+		messages, err := e.Messages()
+		if err != nil {
+			log.Fatalf("Failed to read entry %d: %v", i+1, err)
+		}
+		if messages != nil {
+			prompt := func(splitter.ProjectContext) []provider.Message { return messages }
+			if p, err = provider.Chat(p, prompt, e.Streamed()); err != nil {
+				log.Fatalf("Failed to replay entry %d: %v", i+1, err)
+			}
+		}
+		p = provider.WithEndpoint(p, *endpoint, "")
+		if backend != nil {
+			backend.set(e.Response)
+		}
+
+		start := time.Now()
+		result, err := lsp.Flow(p, e.Context, e.Sampling, context.Background(), io.Discard)
+		latency := time.Since(start)
+		recorded := time.Duration(e.LatencyMs) * time.Millisecond
+		recordedTotal += recorded
+		replayedTotal += latency
+
+		status := "same"
+		switch {
+		case err != nil:
+			failed++
+			status = "error: " + err.Error()
+		case result == e.Result:
+			matched++
+		default:
+			status = "differs"
+		}
+		fmt.Printf("%4d  %-40s  %8v -> %8v  %s\n", i+1, e.Context.File, recorded.Round(time.Millisecond), latency.Round(time.Millisecond), status)
+		if *verbose && err == nil && result != e.Result {
+			fmt.Printf("      recorded: %q\n      replayed: %q\n", e.Result, result)
+		}
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("Recording is empty")
+		return
+	}
+	n := time.Duration(len(entries))
+	fmt.Printf("\n%d/%d results identical, %d errors\n", matched, len(entries), failed)
+	fmt.Printf("Average latency: recorded %v, replayed %v\n",
+		(recordedTotal / n).Round(time.Millisecond), (replayedTotal / n).Round(time.Millisecond))
+}
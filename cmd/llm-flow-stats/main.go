@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/festeh/llm_flow/lsp/telemetry"
+)
+
+func main() {
+	path := flag.String("file", telemetry.DefaultPath(), "Telemetry file written by lsp-server")
+	flag.Parse()
+
+	f, err := os.Open(*path)
+	if err != nil {
+		log.Fatalf("Failed to open telemetry file: %v", err)
+	}
+	defer f.Close()
+
+	summaries, err := telemetry.Summarize(f)
+	if err != nil {
+		log.Fatalf("Failed to read telemetry: %v", err)
+	}
+	if len(summaries) == 0 {
+		fmt.Println("No predictions recorded yet")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tMODEL\tPREDICTIONS\tSHOWN\tACCEPTED\tPARTIAL\tREJECTED\tACCEPT RATE\tAVG LATENCY")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.1f%%\t%v\n",
+			s.Provider, s.Model, s.Predictions, s.Shown, s.Accepted, s.Partial, s.Rejected,
+			s.AcceptanceRate()*100, s.AvgLatency())
+	}
+	w.Flush()
+}
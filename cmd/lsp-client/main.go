@@ -36,21 +36,22 @@ func main() {
 	var firstResponseTime time.Time
 	var lastResponseTime time.Time
 
-	// Send predict request
-	request := jsonrpcMessage{
+	// The server rejects requests until the client has initialized
+	send(conn, jsonrpcMessage{
 		JSONRPC: "2.0",
 		ID:      1,
+		Method:  "initialize",
+		Params:  map[string]interface{}{},
+	})
+	send(conn, jsonrpcMessage{JSONRPC: "2.0", Method: "initialized"})
+
+	// Send predict request
+	send(conn, jsonrpcMessage{
+		JSONRPC: "2.0",
+		ID:      2,
 		Method:  "predict",
 		Params:  map[string]string{"text": *input, "providerAndModel": *info},
-	}
-
-	// Marshal and send the request
-	requestBytes, err := json.Marshal(request)
-	if err != nil {
-		log.Fatalf("Failed to marshal request: %v", err)
-	}
-
-	fmt.Fprintf(conn, "Content-Length: %d\r\n\r\n%s", len(requestBytes), requestBytes)
+	})
 
 	// Set read deadline to prevent hanging
 	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
@@ -101,6 +102,14 @@ func main() {
 	}
 }
 
+func send(conn net.Conn, request jsonrpcMessage) {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		log.Fatalf("Failed to marshal request: %v", err)
+	}
+	fmt.Fprintf(conn, "Content-Length: %d\r\n\r\n%s", len(requestBytes), requestBytes)
+}
+
 func readMessage(r *bufio.Reader) ([]byte, error) {
 	var contentLength int
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp"
+)
+
+// How long the launcher waits for a freshly started daemon
+const daemonStartTimeout = 5 * time.Second
+
+// runLauncher connects stdio to the shared daemon, starting it first when no
+// daemon is listening on socket
+func runLauncher(socket string) int {
+	if socket == "" {
+		socket = lsp.DefaultSocketPath()
+	}
+	conn, err := lsp.DialUnix(socket)
+	if err != nil {
+		conn, err = startDaemon(socket)
+	}
+	if err != nil {
+		log.Error("Could not reach the daemon", "socket", socket, "error", err)
+		return 1
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		// Let the daemon see the end of input while its answers drain
+		if unixConn, ok := conn.(*net.UnixConn); ok {
+			unixConn.CloseWrite()
+		}
+	}()
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		log.Error("Connection to the daemon failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// startDaemon runs this binary as a detached shared daemon on socket, passing
+// along the flags given to the launcher, and waits until it accepts
+func startDaemon(socket string) (net.Conn, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-socket", socket, "-shared"}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "connect", "socket", "shared":
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	cmd := exec.Command(exe, args...)
+	// Detach so that the daemon outlives the editor that started it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting daemon: %v", err)
+	}
+	log.Info("Started daemon", "pid", cmd.Process.Pid, "socket", socket)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	deadline := time.Now().Add(daemonStartTimeout)
+	for time.Now().Before(deadline) {
+		if conn, err := lsp.DialUnix(socket); err == nil {
+			return conn, nil
+		}
+		select {
+		case err := <-exited:
+			// Another launcher may have won the race to start one
+			if conn, dialErr := lsp.DialUnix(socket); dialErr == nil {
+				return conn, nil
+			}
+			return nil, fmt.Errorf("daemon exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return nil, fmt.Errorf("daemon did not start within %v", daemonStartTimeout)
+}
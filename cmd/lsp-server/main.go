@@ -2,26 +2,150 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/festeh/llm_flow/lsp"
+	"github.com/festeh/llm_flow/lsp/credentials"
+	"github.com/festeh/llm_flow/lsp/logging"
+	"github.com/festeh/llm_flow/lsp/record"
+	"github.com/festeh/llm_flow/lsp/telemetry"
+	"github.com/festeh/llm_flow/lsp/usage"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run serves until a client sends exit or the process is signalled, and
+// returns the exit code
+func run() int {
 	port := flag.Int("port", 7777, "Server port to listen on")
+	host := flag.String("host", "127.0.0.1", "Interface to listen on; set -token before exposing it beyond localhost")
+	socket := flag.String("socket", "", "Unix socket to listen on instead of TCP")
+	connect := flag.Bool("connect", false, "Proxy stdio to the shared daemon on -socket (or the per-user default), starting it if needed")
+	shared := flag.Bool("shared", false, "Keep serving other clients when one sends exit")
+	wsAddr := flag.String("ws", "", "Also accept WebSocket clients on this address, e.g. 127.0.0.1:7778")
+	wsOrigins := flag.String("ws-origins", "", "Comma-separated origins of web pages allowed to connect over WebSocket besides same-origin ones, or * for any")
+	token := flag.String("token", "", "Credentials spec of the token TCP and WebSocket clients must send, e.g. env:LLM_FLOW_TOKEN")
+	tlsCert := flag.String("tls-cert", "", "Certificate file to serve TCP and WebSocket over TLS")
+	tlsKey := flag.String("tls-key", "", "Key file for -tls-cert")
+	telemetryPath := flag.String("telemetry", "", "File to record prediction outcomes to, e.g. "+telemetry.DefaultPath()+" where llm-flow-stats reads them (disabled by default)")
+	recordPath := flag.String("record", "", "File to record provider requests and responses to (JSONL)")
+	metricsAddr := flag.String("metrics", "", "Address to serve /metrics and /healthz on, e.g. 127.0.0.1:9177 (empty to disable)")
+	logLevel := flag.String("log-level", "info", "Log level: trace, debug, info, warn or error (trace includes prompts)")
+	logFormat := flag.String("log-format", "text", "Log format: text, json or logfmt")
+	logFile := flag.String("log-file", "", "File to append logs to instead of stderr")
+	usagePath := flag.String("usage", usage.DefaultPath(), "File to persist token usage to (empty keeps it in memory)")
 	flag.Parse()
 
 	log.SetTimeFormat(time.StampMilli)
+	logCloser, err := logging.Setup(logging.Options{Level: *logLevel, Format: *logFormat, File: *logFile})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logCloser.Close()
+
+	if *connect {
+		return runLauncher(*socket)
+	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	server := lsp.NewServer(os.Stdout)
+	server.SetShared(*shared)
+	if *token != "" {
+		resolver, err := credentials.New(*token)
+		if err != nil {
+			log.Error("Invalid token spec", "error", err)
+			return 2
+		}
+		if _, err := resolver.Key(); err != nil {
+			log.Error("Could not read token", "error", err)
+			return 2
+		}
+		server.SetToken(resolver)
+	} else if *socket == "" && !isLoopback(*host) {
+		log.Warn("Listening beyond localhost without -token, anyone who can connect gets completions", "host", *host)
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Error("Could not load TLS certificate", "error", err)
+			return 2
+		}
+		server.SetTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+	if *telemetryPath != "" {
+		store, err := telemetry.Open(*telemetryPath)
+		if err != nil {
+			log.Error("Telemetry disabled", "error", err)
+		} else {
+			defer store.Close()
+			server.SetTelemetry(store)
+		}
+	}
+	if *usagePath != "" {
+		store, err := usage.Open(*usagePath)
+		if err != nil {
+			log.Error("Usage will not be persisted", "error", err)
+		} else {
+			server.SetUsageStore(store)
+		}
+	}
+	if *recordPath != "" {
+		recorder, err := record.Open(*recordPath)
+		if err != nil {
+			log.Error("Recording disabled", "error", err)
+		} else {
+			defer recorder.Close()
+			server.SetRecorder(recorder)
+		}
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := server.ServeMetrics(ctx, *metricsAddr); err != nil {
+				log.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	if *wsAddr != "" {
+		if *wsOrigins != "" {
+			server.SetAllowedOrigins(strings.Split(*wsOrigins, ","))
+		}
+		go func() {
+			if err := server.ServeWebSocket(ctx, *wsAddr); err != nil {
+				log.Error("WebSocket server error", "error", err)
+			}
+		}()
+	}
+	if *socket != "" {
+		err = server.ServeUnix(ctx, *socket)
+	} else {
+		err = server.Serve(ctx, fmt.Sprintf("%s:%d", *host, *port))
+	}
+	if err != nil {
+		log.Error("Server error", "error", err)
+		return 1
+	}
+	return server.ExitCode()
+}
 
-	addr := fmt.Sprintf(":%d", *port)
-	if err := server.Serve(ctx, addr); err != nil {
-		log.Error("Server error: %v", err)
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
@@ -2,11 +2,16 @@ module github.com/festeh/llm_flow
 
 go 1.22.0
 
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/charmbracelet/log v0.4.0
+	github.com/daulet/tokenizers v1.20.2
+	github.com/gorilla/websocket v1.5.3
+)
+
 require (
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
 	github.com/charmbracelet/lipgloss v0.10.0 // indirect
-	github.com/charmbracelet/log v0.4.0 // indirect
-	github.com/daulet/tokenizers v1.20.2 // indirect
 	github.com/go-logfmt/logfmt v0.6.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -0,0 +1,100 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/usage"
+)
+
+type UsageParams struct {
+	// Since is the first day (YYYY-MM-DD) to report, defaults to 30 days ago
+	Since string `json:"since"`
+}
+
+type UsageResult struct {
+	Records  []usage.Record `json:"records"`
+	Today    usage.Totals   `json:"today"`
+	Month    usage.Totals   `json:"month"`
+	Budget   usage.Budget   `json:"budget"`
+	Exceeded string         `json:"exceeded,omitempty"`
+}
+
+// SetUsageStore replaces the in-memory usage store, e.g. with a persistent one
+func (s *Server) SetUsageStore(store *usage.Store) {
+	s.usage = store
+}
+
+// HandleUsage handles the llm_flow/usage request
+func (s *Server) HandleUsage(ctx context.Context, params json.RawMessage) (*UsageResult, error) {
+	var usageParams UsageParams
+	if err := decodeParams(params, &usageParams); err != nil {
+		return nil, err
+	}
+	if usageParams.Since == "" {
+		usageParams.Since = time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	}
+	cfg := s.connFrom(ctx).config
+	cfg.mu.Lock()
+	budget := cfg.budget
+	cfg.mu.Unlock()
+	reason, _ := s.usage.Exceeded(budget)
+	return &UsageResult{
+		Records:  s.usage.Records(usageParams.Since),
+		Today:    s.usage.Today(),
+		Month:    s.usage.Month(),
+		Budget:   budget,
+		Exceeded: reason,
+	}, nil
+}
+
+// account records the tokens used by one flow, estimating them from the
+// request body when the provider didn't report usage
+func (s *Server) account(ctx context.Context, route Route, request map[string]interface{}, result string, reported *usage.Tokens) {
+	var tokens usage.Tokens
+	if reported != nil {
+		tokens = *reported
+	} else {
+		tokens = usage.Tokens{
+			Prompt:     countTokens(route, promptText(request)),
+			Completion: countTokens(route, result),
+			Estimated:  true,
+		}
+	}
+	cost, err := s.usage.Add(route.Provider.Name(), route.Model, route.Repo, tokens, route.Price)
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to save usage", "error", err)
+	}
+	log.FromContext(ctx).Debug("Usage", "prompt", tokens.Prompt, "completion", tokens.Completion, "estimated", tokens.Estimated, "cost", cost)
+}
+
+// promptText is the text of a request body the provider reads: its prompt,
+// prefix and suffix, or all of its chat messages
+func promptText(request map[string]interface{}) string {
+	var b strings.Builder
+	for _, key := range []string{"prompt", "inputs", "prefix", "suffix"} {
+		if text, ok := request[key].(string); ok {
+			b.WriteString(text)
+		}
+	}
+	if messages, ok := request["messages"].([]provider.Message); ok {
+		for _, message := range messages {
+			b.WriteString(message.Content)
+		}
+	}
+	return b.String()
+}
+
+// countTokens uses the model tokenizer when available, or assumes four
+// characters per token
+func countTokens(route Route, text string) int {
+	if route.Tokenizer != nil {
+		ids, _ := route.Tokenizer.Encode(text, false)
+		return len(ids)
+	}
+	return (len(text) + 3) / 4
+}
@@ -0,0 +1,69 @@
+package lsp
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Unauthorized answers an initialize request without a valid token
+const Unauthorized = -32001
+
+// How long a network client has to send its token
+const authTimeout = 10 * time.Second
+
+// TokenSource yields the shared secret network clients must present, e.g. a
+// credentials.Resolver
+type TokenSource interface {
+	Key() (string, error)
+}
+
+// SetToken requires TCP and WebSocket clients to authenticate with the token
+// from src. Unix socket clients are trusted through file permissions.
+func (s *Server) SetToken(src TokenSource) {
+	s.token = src
+}
+
+// SetTLS encrypts the TCP and WebSocket transports
+func (s *Server) SetTLS(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// checkToken compares token with the configured one in constant time
+func (s *Server) checkToken(token string) error {
+	if s.token == nil {
+		return nil
+	}
+	want, err := s.token.Key()
+	if err != nil {
+		return fmt.Errorf("error reading token: %v", err)
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return fmt.Errorf("invalid token")
+	}
+	return nil
+}
+
+// authenticate checks the first message of an unauthenticated connection,
+// which must be an initialize request with initializationOptions.token. The
+// request id is returned to answer failures.
+func (s *Server) authenticate(message []byte) (*ID, error) {
+	var request struct {
+		Method string `json:"method"`
+		ID     *ID    `json:"id"`
+		Params struct {
+			InitializationOptions struct {
+				Token string `json:"token"`
+			} `json:"initializationOptions"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(message, &request); err != nil {
+		return nil, fmt.Errorf("error parsing message: %v", err)
+	}
+	if request.Method != "initialize" {
+		return request.ID, fmt.Errorf("expected initialize, got %q", request.Method)
+	}
+	return request.ID, s.checkToken(request.Params.InitializationOptions.Token)
+}
@@ -0,0 +1,82 @@
+// Package block shapes a multi-line completion into the block the cursor is
+// in: the completion ends where the model dedents out of that block or
+// closes a bracket it did not open, and never ends inside a bracket it did.
+package block
+
+import "strings"
+
+// Trim cuts completion down to the cursor's block. before and after are the
+// text of the cursor's line on either side of it.
+func Trim(completion, before, after string) string {
+	indent := indentWidth(before)
+	// Brackets left open around the cursor may be closed by the completion
+	depth := max(0, delta(before)+delta(after))
+	lines := strings.Split(completion, "\n")
+	kept := 0
+	// balanced is the number of lines after which every bracket the
+	// completion opened was closed again
+	balanced := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if i > 0 && trimmed != "" {
+			if indentWidth(line) < indent {
+				break
+			}
+			if depth == 0 && strings.ContainsAny(trimmed[:1], closers) {
+				break
+			}
+		}
+		depth += delta(line)
+		if depth < 0 {
+			if i > 0 {
+				// The line closed a bracket from before the cursor; it and
+				// what follows belong to the enclosing code
+				break
+			}
+			depth = 0
+		}
+		kept = i + 1
+		if depth == 0 {
+			balanced = kept
+		}
+	}
+	if depth > 0 {
+		kept = max(balanced, 1)
+	}
+	return strings.TrimRight(strings.Join(lines[:kept], "\n"), " \t\r\n")
+}
+
+const (
+	openers = "([{"
+	closers = ")]}"
+)
+
+// delta is the number of brackets line opens minus those it closes, not
+// counting those in string literals
+func delta(line string) int {
+	n := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case strings.IndexByte(openers, c) >= 0:
+			n++
+		case strings.IndexByte(closers, c) >= 0:
+			n--
+		}
+	}
+	return n
+}
+
+// indentWidth is the length of the leading whitespace of line
+func indentWidth(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
@@ -0,0 +1,86 @@
+package block
+
+import "testing"
+
+func TestTrim(t *testing.T) {
+	tests := []struct {
+		name       string
+		before     string
+		after      string
+		completion string
+		want       string
+	}{
+		{
+			name:       "brace dedent",
+			before:     "\t",
+			completion: "return nil\n}\n\nfunc g() {\n}",
+			want:       "return nil",
+		},
+		{
+			name:       "brace block opened by the completion",
+			before:     "\t",
+			completion: "if err != nil {\n\t\treturn err\n\t}\n\treturn nil\n}",
+			want:       "if err != nil {\n\t\treturn err\n\t}\n\treturn nil",
+		},
+		{
+			name:       "closing bracket at the same indentation",
+			completion: "a()\n}\nb()",
+			want:       "a()",
+		},
+		{
+			name:       "bracket open before the cursor",
+			before:     "\tx := []int{",
+			completion: "1, 2,\n\t}\n\tuse(x)\n}",
+			want:       "1, 2,\n\t}\n\tuse(x)",
+		},
+		{
+			name:       "bracket closed after the cursor",
+			before:     "\tf(",
+			after:      ")",
+			completion: "a, b\n\tg()",
+			want:       "a, b\n\tg()",
+		},
+		{
+			name:       "brackets in strings",
+			before:     "\t",
+			completion: "s := \"{\"\n\tt := '('\n}",
+			want:       "s := \"{\"\n\tt := '('",
+		},
+		{
+			name:       "indentation dedent",
+			before:     "    ",
+			completion: "return x\n\ndef other():\n    pass",
+			want:       "return x",
+		},
+		{
+			name:       "indentation block opened by the completion",
+			before:     "    ",
+			completion: "for i in range(3):\n        print(i)\n    return\nprint('done')",
+			want:       "for i in range(3):\n        print(i)\n    return",
+		},
+		{
+			name:       "unterminated block",
+			before:     "\t",
+			completion: "x := 1\n\tif ok {\n\t\tdo()",
+			want:       "x := 1",
+		},
+		{
+			name:       "unterminated first line",
+			before:     "\t",
+			completion: "if ok {\n\t\tdo()",
+			want:       "if ok {",
+		},
+		{
+			name:       "trailing whitespace",
+			completion: "x := 1  \n\n",
+			want:       "x := 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Trim(tt.completion, tt.before, tt.after); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
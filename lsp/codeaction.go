@@ -0,0 +1,244 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/document"
+)
+
+// Kinds of the code actions offered
+const (
+	KindRewrite = "refactor.rewrite"
+	KindSource  = "source"
+)
+
+// CodeActionCommand carries out a code action for clients that cannot
+// resolve them, taking the action's data as its only argument
+const CodeActionCommand = "llm_flow.codeAction"
+
+// testAction writes a test instead of rewriting the selection
+const testAction = "table_test"
+
+const testInstructions = `You write tests for a selection of code, in the conventions of its language and of the code around it.
+
+Answer with only the test code in a single fenced code block, without explanation.`
+
+// codeAction is an action on the selection carried out by a chat model
+type codeAction struct {
+	id          string
+	title       string
+	kind        string
+	instruction string
+}
+
+var codeActions = []codeAction{
+	{
+		id:          "doc_comment",
+		title:       "Add doc comment",
+		kind:        KindRewrite,
+		instruction: "Add a doc comment to each declaration that lacks one, in the conventions of the language. Leave the code itself unchanged.",
+	},
+	{
+		id:          testAction,
+		title:       "Generate table-driven test",
+		kind:        KindSource,
+		instruction: "Write a table-driven test for the selected code, with cases for its edge cases and errors.",
+	},
+	{
+		id:          "error_handling",
+		title:       "Add error handling",
+		kind:        KindRewrite,
+		instruction: "Handle the errors the code ignores or drops, the way the code around it handles errors.",
+	},
+	{
+		id:          "explain",
+		title:       "Explain in comments",
+		kind:        KindRewrite,
+		instruction: "Add comments explaining what the code does and why, for a reader new to it. Leave the code itself unchanged.",
+	},
+}
+
+func findCodeAction(id string) (codeAction, bool) {
+	for _, action := range codeActions {
+		if action.id == id {
+			return action, true
+		}
+	}
+	return codeAction{}, false
+}
+
+// codeActionData is the data of an unresolved code action
+type codeActionData struct {
+	Action       string                 `json:"action"`
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Range        Range                  `json:"range"`
+}
+
+// HandleCodeAction offers the code actions on a selection. They come without
+// edit, which codeAction/resolve asks the provider for, or as a command for
+// clients that cannot resolve edits.
+func (s *Server) HandleCodeAction(ctx context.Context, raw json.RawMessage) ([]CodeAction, error) {
+	var params CodeActionParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+	actions := []CodeAction{}
+	uri := params.TextDocument.URI
+	if params.Range.Start == params.Range.End {
+		return actions, nil
+	}
+	if _, exists := s.snapshot(ctx, uri); !exists {
+		return actions, nil
+	}
+	route, err := s.routeFor(ctx, uri)
+	if err != nil || route.Provider == nil || route.Redactor.Denied(route.Repo, uriToPath(uri)) {
+		return actions, nil
+	}
+	resolves := false
+	for _, property := range s.capabilities(ctx).TextDocument.CodeAction.ResolveSupport.Properties {
+		resolves = resolves || property == "edit"
+	}
+	for _, action := range codeActions {
+		if !kindWanted(action.kind, params.Context.Only) {
+			continue
+		}
+		data, err := json.Marshal(codeActionData{Action: action.id, TextDocument: params.TextDocument, Range: params.Range})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling code action: %v", err)
+		}
+		codeAction := CodeAction{Title: action.title, Kind: action.kind}
+		if resolves {
+			codeAction.Data = data
+		} else {
+			codeAction.Command = &Command{
+				Title:     action.title,
+				Command:   CodeActionCommand,
+				Arguments: []interface{}{json.RawMessage(data)},
+			}
+		}
+		actions = append(actions, codeAction)
+	}
+	return actions, nil
+}
+
+// kindWanted reports whether kind is one of only or a sub-kind of one
+func kindWanted(kind string, only []string) bool {
+	if len(only) == 0 {
+		return true
+	}
+	for _, wanted := range only {
+		if kind == wanted || strings.HasPrefix(kind, wanted+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleCodeActionResolve fills in the edit of a code action
+func (s *Server) HandleCodeActionResolve(ctx context.Context, raw json.RawMessage) (*CodeAction, error) {
+	var action CodeAction
+	if err := decodeParams(raw, &action); err != nil {
+		return nil, err
+	}
+	var data codeActionData
+	if err := decodeParams(action.Data, &data); err != nil {
+		return nil, err
+	}
+	_, edit, err := s.resolveCodeAction(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	action.Edit = edit
+	return &action, nil
+}
+
+// resolveCodeAction carries out the action of data, returning its title and
+// the edit it makes
+func (s *Server) resolveCodeAction(ctx context.Context, data codeActionData) (string, *WorkspaceEdit, error) {
+	action, ok := findCodeAction(data.Action)
+	if !ok {
+		return "", nil, newError(InvalidParams, "unknown code action: %s", data.Action)
+	}
+	ctx = log.WithContext(ctx, log.FromContext(ctx).With("action", action.id))
+	params := RewriteParams{TextDocument: data.TextDocument, Range: data.Range, Instruction: action.instruction}
+	var edit *WorkspaceEdit
+	var err error
+	if action.id == testAction {
+		edit, err = s.generateTest(ctx, params)
+	} else {
+		edit, err = s.rewrite(ctx, params)
+	}
+	return action.title, edit, err
+}
+
+// generateTest writes a test for the selection of params. Go tests are
+// appended to the _test.go file next to the document, which is created if
+// needed; other tests are appended to the document itself.
+func (s *Server) generateTest(ctx context.Context, params RewriteParams) (*WorkspaceEdit, error) {
+	uri := params.TextDocument.URI
+	target := uri
+	if strings.HasSuffix(uri, ".go") && !strings.HasSuffix(uri, "_test.go") {
+		target = strings.TrimSuffix(uri, ".go") + "_test.go"
+	}
+	var version *int
+	doc, exists := s.snapshot(ctx, target)
+	if exists {
+		v := doc.Version
+		version = &v
+	} else {
+		text, err := os.ReadFile(uriToPath(target))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("error reading %s: %v", target, err)
+		}
+		if err == nil {
+			doc = document.New(target, "", 0, string(text))
+		}
+	}
+
+	file := target[strings.LastIndexByte(target, '/')+1:]
+	if doc == nil {
+		workspace := s.capabilities(ctx).Workspace.WorkspaceEdit
+		canCreate := false
+		for _, operation := range workspace.ResourceOperations {
+			canCreate = canCreate || operation == "create"
+		}
+		if !workspace.DocumentChanges || !canCreate {
+			return nil, newError(InvalidRequest, "client cannot create %s", file)
+		}
+		params.Instruction += fmt.Sprintf(" The test goes in the new file %s: write all of it, with the package clause and imports.", file)
+	} else {
+		params.Instruction += fmt.Sprintf(" The test is appended to %s: write only the new test functions.", file)
+	}
+	g, err := s.generate(ctx, params, testInstructions, "Writing test")
+	if err != nil {
+		return nil, err
+	}
+	code := strings.TrimRight(g.code, "\n") + "\n"
+
+	if doc == nil {
+		return &WorkspaceEdit{DocumentChanges: []interface{}{
+			CreateFile{Kind: "create", URI: target},
+			TextDocumentEdit{
+				TextDocument: OptionalVersionedTextDocumentIdentifier{URI: target},
+				Edits:        []TextEdit{{NewText: code}},
+			},
+		}}, nil
+	}
+	text := doc.Text()
+	separator := "\n"
+	if !strings.HasSuffix(text, "\n") {
+		separator = "\n\n"
+	}
+	end := len(text)
+	return s.workspaceEdit(ctx, target, version, TextEdit{
+		Range:   offsetRange(doc, end, end, s.positionEncoding(ctx)),
+		NewText: separator + code,
+	}), nil
+}
@@ -1,17 +1,36 @@
 package lsp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/charmbracelet/log"
 	"github.com/daulet/tokenizers"
+	"github.com/festeh/llm_flow/lsp/credentials"
 	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/ratelimit"
+	"github.com/festeh/llm_flow/lsp/redact"
+	"github.com/festeh/llm_flow/lsp/settings"
+	"github.com/festeh/llm_flow/lsp/usage"
 )
 
+// How often config files are checked for changes
+const settingsPollInterval = 2 * time.Second
+
 type SetConfigParams struct {
 	Repo     string `json:"repo"`
 	Provider string `json:"provider"`
 	Model    string `json:"model"`
+	Profile  string `json:"profile"`
+	// APIKey is the key itself. Clients may not name credential sources,
+	// which read files or run commands on the server's host.
+	APIKey string `json:"api_key"`
+	// Sampling overrides the profile's sampling parameters
+	provider.Sampling
 }
 
 // Config holds server configuration
@@ -20,41 +39,454 @@ type Config struct {
 	Provider  *provider.Provider
 	Tokenizer *tokenizers.Tokenizer
 	Model     *string
+	// Profile is the active profile from the config files, if any
+	Profile       string
+	ContextBudget int
+	Sampling      provider.Sampling
+	Price         usage.Price
+
+	mu sync.Mutex
+	// applyMu orders the changes of the config, which are built without
+	// holding mu
+	applyMu  sync.Mutex
+	params   SetConfigParams
+	routes   []routeRule
+	redactor *redact.Redactor
+	budget   usage.Budget
+	limits   map[string]ratelimit.Limits
+	// fallback replaces every route once the budget is used up
+	fallback    *Route
+	watchedRepo string
+	stopWatch   context.CancelFunc
 }
 
-func (c *Config) HandleSetConfig(params json.RawMessage) error {
+func (c *Config) HandleSetConfig(ctx context.Context, params json.RawMessage) error {
 	var configParams SetConfigParams
-	if err := json.Unmarshal(params, &configParams); err != nil {
-		return fmt.Errorf("error parsing set_config params: %v", err)
-	}
-	c.Repo = configParams.Repo
-	if err := c.SetProvider(configParams.Provider, configParams.Model); err != nil {
+	if err := decodeParams(params, &configParams); err != nil {
 		return err
 	}
-	return c.SetTokenizer()
+	return c.Apply(ctx, configParams)
 }
 
-func (c *Config) SetProvider(providerName string, model string) error {
-	p, err := provider.NewProvider(providerName, model)
+// validate rejects an API key written as a credentials spec, as clients
+// send their settings over the network
+func (p SetConfigParams) validate() error {
+	for _, kind := range []string{"env:", "file:", "cmd:", "key:"} {
+		if strings.HasPrefix(p.APIKey, kind) {
+			return newError(InvalidParams, "api_key must be the key itself, credential sources are only read from %s", settings.GlobalPath())
+		}
+	}
+	return nil
+}
+
+// Apply configures the provider from params, resolving profiles from the
+// config files of params.Repo, and keeps it up to date as those files change.
+// Providers and tokenizer are set up before the config is locked, so that
+// requests are routed meanwhile.
+func (c *Config) Apply(ctx context.Context, params SetConfigParams) error {
+	if err := params.validate(); err != nil {
+		return err
+	}
+	c.applyMu.Lock()
+	defer c.applyMu.Unlock()
+	l, err := load(params)
+	var tokenizer *tokenizers.Tokenizer
+	var tokenizerErr error
+	if err == nil {
+		tokenizer, tokenizerErr = c.tokenizerFor(ctx, l)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.params = params
+	c.Repo = params.Repo
+	c.watch(ctx, params.Repo)
 	if err != nil {
 		return err
 	}
-	c.Provider = &p
-	c.Model = &model
-	return nil
+	c.swap(ctx, l)
+	if tokenizer != nil {
+		c.Tokenizer = tokenizer
+	}
+	return tokenizerErr
+}
+
+// loaded is a configuration read from the config files, not yet in use
+type loaded struct {
+	profileName string
+	profile     settings.Profile
+	provider    provider.Provider
+	repo        string
+	redactor    *redact.Redactor
+	limits      map[string]ratelimit.Limits
+	routes      []routeRule
+	budget      usage.Budget
+	fallback    *Route
+}
+
+// load reads the config files and sets up the provider described by params,
+// plus one provider per routing rule. Explicit provider and model override
+// the profile.
+func load(params SetConfigParams) (*loaded, error) {
+	s, err := settings.Load(params.Repo)
+	if err != nil {
+		return nil, err
+	}
+	profile := settings.Profile{Provider: params.Provider, Model: params.Model}
+	profileName := ""
+	if params.Profile != "" || (params.Provider == "" && s.Profile != "") {
+		if profile, err = s.Get(params.Profile); err != nil {
+			return nil, err
+		}
+		profileName = params.Profile
+		if profileName == "" {
+			profileName = s.Profile
+		}
+		if params.Provider != "" {
+			profile.Provider = params.Provider
+		}
+		if params.Model != "" {
+			profile.Model = params.Model
+		}
+	}
+	if params.APIKey != "" {
+		profile.APIKey = credentials.Literal(params.APIKey)
+	}
+	profile.Sampling = profile.Sampling.Merge(params.Sampling)
+	redactor, err := redact.New(s.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	l := &loaded{
+		profileName: profileName,
+		profile:     profile,
+		repo:        params.Repo,
+		redactor:    redactor,
+		limits:      s.Limits,
+		budget:      s.Budget,
+	}
+	if l.provider, err = newProfileProvider(profile); err != nil {
+		return nil, err
+	}
+	if l.routes, err = l.buildRoutes(s); err != nil {
+		closeProvider(l.provider)
+		return nil, err
+	}
+	if l.fallback, err = l.buildFallback(s); err != nil {
+		closeProvider(l.provider)
+		closeRules(l.routes)
+		return nil, err
+	}
+	return l, nil
 }
 
-func (c *Config) SetTokenizer() error {
-	if c.Provider == nil {
-		return fmt.Errorf("provider not set")
+// swap puts l in use, releasing the providers it replaces. c.mu must be held.
+func (c *Config) swap(ctx context.Context, l *loaded) {
+	c.setProvider(l.provider, l.profile.Model)
+	c.Profile = l.profileName
+	c.ContextBudget = l.profile.ContextBudget
+	c.Sampling = l.profile.Sampling
+	c.Price = l.profile.Price
+	c.redactor = l.redactor
+	c.limits = l.limits
+	c.closeRoutes()
+	c.routes = l.routes
+	c.budget = l.budget
+	c.fallback = l.fallback
+	log.FromContext(ctx).Info("Provider configured", "provider", l.profile.Provider, "model", l.profile.Model, "profile", c.Profile, "routes", len(l.routes))
+}
+
+// tokenizerFor downloads the tokenizer of the model of l, or returns nil if
+// it is loaded already
+func (c *Config) tokenizerFor(ctx context.Context, l *loaded) (*tokenizers.Tokenizer, error) {
+	// The mock model is a script, not a tokenizer name
+	if l.provider.Name() == "mock" {
+		return nil, nil
+	}
+	c.mu.Lock()
+	current := c.Tokenizer != nil && c.Model != nil && *c.Model == l.profile.Model
+	c.mu.Unlock()
+	if current {
+		return nil, nil
+	}
+	tokenizer, err := tokenizers.FromPretrained(l.profile.Model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tokenizer: %v", err)
 	}
+	log.FromContext(ctx).Info("Tokenizer initialized")
+	return tokenizer, nil
+}
 
-	tokenizer, err := tokenizers.FromPretrained(*c.Model)
+func newProfileProvider(profile settings.Profile) (provider.Provider, error) {
+	p, err := provider.NewProvider(profile.Provider, profile.Model, profile.APIKey)
 	if err != nil {
-		return fmt.Errorf("failed to create tokenizer: %v", err)
+		return nil, err
+	}
+	if err := profile.Sampling.Validate(profile.Provider, p.Capabilities()); err != nil {
+		closeProvider(p)
+		return nil, err
+	}
+	if profile.Template != "" {
+		templated, ok := p.(provider.Templated)
+		if !ok {
+			closeProvider(p)
+			return nil, fmt.Errorf("provider %s does not support templates", profile.Provider)
+		}
+		if err := templated.SetTemplate(profile.Template); err != nil {
+			closeProvider(p)
+			return nil, err
+		}
 	}
+	return provider.WithEndpoint(p, profile.Endpoint, profile.ChatEndpoint), nil
+}
 
-	c.Tokenizer = tokenizer
-	log.Info("Tokenizer initiazlied")
+func closeProvider(p provider.Provider) {
+	if closer, ok := p.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// Route is the provider chosen for a document
+type Route struct {
+	// Name of the matching rule, or of the active profile for the default route
+	Name          string
+	Repo          string
+	Provider      provider.Provider
+	Model         string
+	ContextBudget int
+	Sampling      provider.Sampling
+	Redactor      *redact.Redactor
+	Price         usage.Price
+	// Limits of the provider, defaults apply when unset
+	Limits ratelimit.Limits
+	// Tokenizer estimates usage when the provider doesn't report it, may be nil
+	Tokenizer *tokenizers.Tokenizer
+}
+
+type routeRule struct {
+	rule  settings.Route
+	route Route
+}
+
+func (l *loaded) buildRoutes(s *settings.Settings) ([]routeRule, error) {
+	var rules []routeRule
+	for _, r := range s.Routes {
+		if r.Profile == "" {
+			closeRules(rules)
+			return nil, fmt.Errorf("route %q has no profile", r.DisplayName())
+		}
+		route, err := l.profileRoute(s, r.DisplayName(), r.Profile)
+		if err != nil {
+			closeRules(rules)
+			return nil, fmt.Errorf("route %s: %v", r.DisplayName(), err)
+		}
+		rules = append(rules, routeRule{rule: r, route: route})
+	}
+	return rules, nil
+}
+
+func (l *loaded) profileRoute(s *settings.Settings, name string, profileName string) (Route, error) {
+	profile, err := s.Get(profileName)
+	if err != nil {
+		return Route{}, err
+	}
+	p, err := newProfileProvider(profile)
+	if err != nil {
+		return Route{}, err
+	}
+	return Route{
+		Name:          name,
+		Repo:          l.repo,
+		Provider:      p,
+		Model:         profile.Model,
+		ContextBudget: profile.ContextBudget,
+		Sampling:      profile.Sampling,
+		Redactor:      l.redactor,
+		Price:         profile.Price,
+		Limits:        limitsFor(l.limits, profile.Provider),
+	}, nil
+}
+
+// limitsFor looks up the configured limits of a provider, whose display name
+// may differ in case from the config key
+func limitsFor(limits map[string]ratelimit.Limits, name string) ratelimit.Limits {
+	return limits[strings.ToLower(name)]
+}
+
+func (l *loaded) buildFallback(s *settings.Settings) (*Route, error) {
+	if s.Budget.Fallback == "" {
+		return nil, nil
+	}
+	route, err := l.profileRoute(s, s.Budget.Fallback, s.Budget.Fallback)
+	if err != nil {
+		return nil, fmt.Errorf("budget fallback: %v", err)
+	}
+	return &route, nil
+}
+
+// withinBudget swaps route for the fallback once the budget is used up, or
+// fails when there is no fallback
+func (c *Config) withinBudget(ctx context.Context, store *usage.Store, route Route) (Route, error) {
+	c.mu.Lock()
+	budget, fallback := c.budget, c.fallback
+	c.mu.Unlock()
+	reason, exceeded := store.Exceeded(budget)
+	if !exceeded {
+		return route, nil
+	}
+	if fallback == nil {
+		return Route{}, fmt.Errorf("%s exceeded, completions paused", reason)
+	}
+	log.FromContext(ctx).Warn("Budget exceeded, using fallback", "reason", reason, "profile", fallback.Name)
+	return *fallback, nil
+}
+
+func closeRules(rules []routeRule) {
+	for _, r := range rules {
+		closeProvider(r.route.Provider)
+	}
+}
+
+func (c *Config) closeRoutes() {
+	closeRules(c.routes)
+	c.routes = nil
+	if c.fallback != nil {
+		closeProvider(c.fallback.Provider)
+		c.fallback = nil
+	}
+}
+
+// Route picks the provider for the document at file: the first matching
+// routing rule, or the default provider
+func (c *Config) Route(file, language string) Route {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.routes {
+		if r.rule.Matches(c.Repo, file, language) {
+			return r.route
+		}
+	}
+	return c.defaultRoute()
+}
+
+// DefaultRoute is the route used when no rule matches
+func (c *Config) DefaultRoute() Route {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.defaultRoute()
+}
+
+func (c *Config) defaultRoute() Route {
+	r := Route{
+		Name:          c.Profile,
+		Repo:          c.Repo,
+		ContextBudget: c.ContextBudget,
+		Sampling:      c.Sampling,
+		Redactor:      c.redactor,
+		Price:         c.Price,
+		Tokenizer:     c.Tokenizer,
+	}
+	if r.Redactor == nil {
+		r.Redactor = redact.Default()
+	}
+	if c.Provider != nil {
+		r.Provider = *c.Provider
+		r.Limits = limitsFor(c.limits, r.Provider.Name())
+	}
+	if c.Model != nil {
+		r.Model = *c.Model
+	}
+	return r
+}
+
+// configured reports whether a provider is set up
+func (c *Config) configured() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Provider != nil
+}
+
+// watch reloads the config whenever the files for repo change, logging
+// with the logger of ctx for as long as the config lives
+func (c *Config) watch(ctx context.Context, repo string) {
+	if c.stopWatch != nil && c.watchedRepo == repo {
+		return
+	}
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	ctx, cancel := context.WithCancel(log.WithContext(context.Background(), log.FromContext(ctx)))
+	c.watchedRepo = repo
+	c.stopWatch = cancel
+	go settings.Watch(ctx, repo, settingsPollInterval, func() {
+		c.applyMu.Lock()
+		defer c.applyMu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		params := c.params
+		c.mu.Unlock()
+		l, err := load(params)
+		if err != nil {
+			log.FromContext(ctx).Error("Failed to reload config", "error", err)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if ctx.Err() != nil {
+			// Closed or watching another repo meanwhile
+			closeProvider(l.provider)
+			closeRules(l.routes)
+			if l.fallback != nil {
+				closeProvider(l.fallback.Provider)
+			}
+			return
+		}
+		c.swap(ctx, l)
+	})
+}
+
+// Close stops watching config files and releases the provider
+func (c *Config) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopWatch != nil {
+		c.stopWatch()
+		c.stopWatch = nil
+	}
+	if c.Provider != nil {
+		closeProvider(*c.Provider)
+	}
+	c.closeRoutes()
+}
+
+func (c *Config) SetProvider(providerName string, model string) error {
+	p, err := provider.NewProvider(providerName, model, "")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setProvider(p, model)
 	return nil
 }
+
+func (c *Config) setProvider(p provider.Provider, model string) {
+	if c.Provider != nil {
+		closeProvider(*c.Provider)
+	}
+	c.Provider = &p
+	c.Model = &model
+}
+
+// SetProvider configures the server with an already constructed provider for
+// messages handled without a connection, skipping the tokenizer download.
+// Used by tools driving the server in-process.
+func (s *Server) SetProvider(repo string, p provider.Provider, model string) {
+	c := s.out.config
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Repo = repo
+	c.Provider = &p
+	c.Model = &model
+}
@@ -0,0 +1,464 @@
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/festeh/llm_flow/lsp/provider/fake"
+)
+
+// testClient talks JSON-RPC to a server over an in-memory connection
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	messages chan Header
+	nextID   int64
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(ctx, server)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+	c := &testClient{t: t, conn: client, messages: make(chan Header, 64)}
+	go func() {
+		defer close(c.messages)
+		r := bufio.NewReader(client)
+		for {
+			message, err := readMessage(r)
+			if err != nil {
+				return
+			}
+			var header Header
+			if err := json.Unmarshal(message, &header); err != nil {
+				t.Errorf("invalid message from server: %s", message)
+				return
+			}
+			c.messages <- header
+		}
+	}()
+	return c
+}
+
+// send writes a raw message
+func (c *testClient) send(message string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(message), message); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+func (c *testClient) notify(method string, params interface{}) {
+	c.t.Helper()
+	message, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(string(message))
+}
+
+// request sends a request without waiting for its response
+func (c *testClient) request(method string, params interface{}) ID {
+	c.t.Helper()
+	c.nextID++
+	id := NumberID(c.nextID)
+	message, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(string(message))
+	return id
+}
+
+// read returns the next message from the server
+func (c *testClient) read() Header {
+	c.t.Helper()
+	select {
+	case header, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return header
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no message from server")
+	}
+	return Header{}
+}
+
+// response waits for the response to id, skipping notifications
+func (c *testClient) response(id ID) Header {
+	c.t.Helper()
+	for {
+		header := c.read()
+		if header.Method == "" && header.ID != nil && *header.ID == id {
+			return header
+		}
+		if header.Method == "" {
+			c.t.Fatalf("response to %v while waiting for %v", header.ID, id)
+		}
+	}
+}
+
+func (c *testClient) call(method string, params interface{}) Header {
+	c.t.Helper()
+	return c.response(c.request(method, params))
+}
+
+func (c *testClient) initialize(options interface{}) {
+	c.t.Helper()
+	response := c.call("initialize", map[string]interface{}{
+		"capabilities":          map[string]interface{}{},
+		"initializationOptions": options,
+	})
+	if response.Error != nil {
+		c.t.Fatalf("initialize: %v", response.Error)
+	}
+	c.notify("initialized", map[string]interface{}{})
+}
+
+// closed waits for the server to close the connection
+func (c *testClient) closed() {
+	c.t.Helper()
+	for {
+		select {
+		case header, ok := <-c.messages:
+			if !ok {
+				return
+			}
+			c.t.Errorf("unexpected message %+v", header)
+		case <-time.After(5 * time.Second):
+			c.t.Fatal("connection still open")
+		}
+	}
+}
+
+func expectError(t *testing.T, response Header, code int) {
+	t.Helper()
+	if response.Error == nil {
+		t.Fatalf("got result %s, want error %d", response.Result, code)
+	}
+	if response.Error.Code != code {
+		t.Fatalf("got error %d (%s), want %d", response.Error.Code, response.Error.Message, code)
+	}
+}
+
+// mockOptions configures the mock provider to answer with the reply
+// described by query, e.g. "text=x&delay=1s"
+func mockOptions(query url.Values) map[string]interface{} {
+	return map[string]interface{}{"provider": "mock", "model": query.Encode()}
+}
+
+func TestLifecycle(t *testing.T) {
+	s := NewServer(io.Discard)
+	c := newTestClient(t, s)
+
+	expectError(t, c.call("llm_flow/usage", nil), ServerNotInitialized)
+	c.initialize(nil)
+	if response := c.call("llm_flow/usage", nil); response.Error != nil {
+		t.Fatalf("usage: %v", response.Error)
+	}
+	if response := c.call("shutdown", nil); response.Error != nil {
+		t.Fatalf("shutdown: %v", response.Error)
+	}
+	expectError(t, c.call("llm_flow/usage", nil), InvalidRequest)
+	c.notify("exit", nil)
+	c.closed()
+	if code := s.ExitCode(); code != 0 {
+		t.Errorf("exit code %d after shutdown", code)
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	s := NewServer(io.Discard)
+	c := newTestClient(t, s)
+	c.initialize(nil)
+	c.notify("exit", nil)
+	c.closed()
+	if code := s.ExitCode(); code != 1 {
+		t.Errorf("exit code %d without shutdown", code)
+	}
+}
+
+func TestSharedSessions(t *testing.T) {
+	s := NewServer(io.Discard)
+	s.SetShared(true)
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	a.initialize(nil)
+	expectError(t, b.call("llm_flow/usage", nil), ServerNotInitialized)
+	b.initialize(nil)
+	if response := a.call("shutdown", nil); response.Error != nil {
+		t.Fatalf("shutdown: %v", response.Error)
+	}
+	expectError(t, a.call("llm_flow/usage", nil), InvalidRequest)
+	if response := b.call("llm_flow/usage", nil); response.Error != nil {
+		t.Errorf("other client refused after shutdown: %v", response.Error)
+	}
+	a.notify("exit", nil)
+	a.closed()
+	if response := b.call("llm_flow/usage", nil); response.Error != nil {
+		t.Errorf("other client refused after exit: %v", response.Error)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		// id is the id of the response, nil when it could not be read
+		id   *ID
+		code int
+	}{
+		{name: "parse error", message: `{"jsonrpc":`, code: ParseError},
+		{name: "batch", message: `[{"jsonrpc":"2.0","id":1,"method":"shutdown"}]`, code: InvalidRequest},
+		{name: "jsonrpc version", message: `{"jsonrpc":"1.0","id":1,"method":"shutdown"}`, id: &ID{Num: 1}, code: InvalidRequest},
+		{name: "no method", message: `{"jsonrpc":"2.0","id":1}`, id: &ID{Num: 1}, code: InvalidRequest},
+		{name: "unknown method", message: `{"jsonrpc":"2.0","id":1,"method":"llm_flow/nope"}`, id: &ID{Num: 1}, code: MethodNotFound},
+		{name: "invalid params", message: `{"jsonrpc":"2.0","id":"a","method":"textDocument/codeAction","params":"x"}`, id: &ID{IsString: true, Str: "a"}, code: InvalidParams},
+		{name: "unknown command", message: `{"jsonrpc":"2.0","id":1,"method":"workspace/executeCommand","params":{"command":"nope"}}`, id: &ID{Num: 1}, code: InvalidParams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, NewServer(io.Discard))
+			c.initialize(nil)
+			c.send(tt.message)
+			response := c.read()
+			expectError(t, response, tt.code)
+			if (response.ID == nil) != (tt.id == nil) || (tt.id != nil && *response.ID != *tt.id) {
+				t.Errorf("got id %v, want %v", response.ID, tt.id)
+			}
+		})
+	}
+}
+
+func TestUnknownNotification(t *testing.T) {
+	c := newTestClient(t, NewServer(io.Discard))
+	c.initialize(nil)
+	c.notify("$/unknown", map[string]interface{}{})
+	id := c.request("llm_flow/usage", nil)
+	if response := c.read(); response.ID == nil || *response.ID != id {
+		t.Fatalf("unknown notification answered: %+v", response)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	c := newTestClient(t, NewServer(io.Discard))
+	c.initialize(mockOptions(url.Values{"text": {"return nil"}, "delay": {"10s"}, "stream": {"false"}}))
+	uri := "file:///tmp/cancel.go"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "go", "version": 1, "text": "package a\n\nfunc f() error {\n\t\n}\n"},
+	})
+	id := c.request("predict_editor", map[string]interface{}{"uri": uri, "line": 3, "pos": 1})
+	c.notify("$/cancelRequest", map[string]interface{}{"id": id})
+	expectError(t, c.response(id), RequestCancelled)
+}
+
+func TestShutdownDrainsFlows(t *testing.T) {
+	c := newTestClient(t, NewServer(io.Discard))
+	c.initialize(mockOptions(url.Values{"text": {"x := 1"}, "delay": {"200ms"}, "stream": {"false"}}))
+	uri := "file:///tmp/drain.go"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "go", "version": 1, "text": "package a\n\nvar x = 0\n"},
+	})
+	rewrite := c.request("llm_flow/rewrite", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"range":        Range{Start: Position{Line: 2}, End: Position{Line: 3}},
+		"instruction":  "use a short variable declaration",
+	})
+	time.Sleep(50 * time.Millisecond)
+	shutdown := c.request("shutdown", nil)
+	if response := c.response(rewrite); response.Error != nil {
+		t.Errorf("in-flight rewrite failed on shutdown: %v", response.Error)
+	}
+	if response := c.response(shutdown); response.Error != nil {
+		t.Fatalf("shutdown: %v", response.Error)
+	}
+	expectError(t, c.call("llm_flow/rewrite", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"range":        Range{Start: Position{Line: 2}, End: Position{Line: 3}},
+		"instruction":  "use a short variable declaration",
+	}), InvalidRequest)
+}
+
+func TestSharedDocuments(t *testing.T) {
+	s := NewServer(io.Discard)
+	s.SetShared(true)
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	a.initialize(nil)
+	b.initialize(nil)
+	uri := "file:///tmp/shared.go"
+	open := map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "go", "version": 1, "text": "package a\n"},
+	}
+	a.notify("textDocument/didOpen", open)
+	a.notify("textDocument/didOpen", open)
+	b.notify("textDocument/didOpen", open)
+	b.call("llm_flow/usage", nil)
+
+	// a opened it twice but closes it once, and disconnects without closing
+	a.notify("textDocument/didClose", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}})
+	a.notify("textDocument/didOpen", open)
+	a.conn.Close()
+	a.closed()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		clients := len(s.clients)
+		s.mu.Unlock()
+		if clients == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("disconnected client still served")
+		}
+	}
+	if _, ok := s.documents.Get(uri); !ok {
+		t.Fatal("document closed while another client has it open")
+	}
+	b.notify("textDocument/didClose", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}})
+	b.call("llm_flow/usage", nil)
+	if _, ok := s.documents.Get(uri); ok {
+		t.Error("document still open after every client closed it")
+	}
+}
+
+func TestMetricsMethodLabel(t *testing.T) {
+	s := NewServer(io.Discard)
+	c := newTestClient(t, s)
+	expectError(t, c.call("llm_flow/nope", nil), ServerNotInitialized)
+	c.initialize(nil)
+	expectError(t, c.call("llm_flow/nope/again", nil), MethodNotFound)
+
+	want := []string{
+		`llm_flow_messages_total{method="other"} 2`,
+		`llm_flow_messages_total{method="initialize"} 1`,
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		var b strings.Builder
+		s.metrics.registry.Write(&b)
+		if strings.Contains(b.String(), "llm_flow/nope") {
+			t.Fatalf("unknown method used as a label:\n%s", b.String())
+		}
+		missing := ""
+		for _, line := range want {
+			if !strings.Contains(b.String(), line+"\n") {
+				missing = line
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s in:\n%s", missing, b.String())
+		}
+	}
+}
+
+func TestRewriteThroughEndpoint(t *testing.T) {
+	backend := fake.NewServer(fake.Options{Format: fake.OpenAI, Replies: []fake.Reply{{Text: "```go\nx := 1\n```"}}})
+	defer backend.Close()
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	global := fmt.Sprintf("[profiles.proxied]\nprovider = \"mock\"\nmodel = \"text=wrong\"\nendpoint = %q\n", backend.URL)
+	if err := os.MkdirAll(filepath.Join(config, "llm_flow"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config, "llm_flow", "config.toml"), []byte(global), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(t, NewServer(io.Discard))
+	c.initialize(map[string]interface{}{"profile": "proxied", "repo": t.TempDir()})
+	uri := "file:///tmp/endpoint.go"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "go", "version": 1, "text": "package a\n\nvar x = 1\n"},
+	})
+	response := c.call("llm_flow/rewrite", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"range":        Range{Start: Position{Line: 2}, End: Position{Line: 3}},
+		"instruction":  "use a short variable declaration",
+	})
+	if response.Error != nil {
+		t.Fatalf("rewrite: %v", response.Error)
+	}
+	var edit WorkspaceEdit
+	if err := json.Unmarshal(response.Result, &edit); err != nil {
+		t.Fatal(err)
+	}
+	if edits := edit.Changes[uri]; len(edits) != 1 || edits[0].NewText != "x := 1\n" {
+		t.Errorf("got %s, want the answer of the configured endpoint", response.Result)
+	}
+	requests := backend.Requests()
+	if len(requests) != 1 || requests[0]["messages"] == nil {
+		t.Errorf("endpoint got %v, want one chat request", requests)
+	}
+}
+
+func TestSharedCallResponses(t *testing.T) {
+	s := NewServer(io.Discard)
+	s.SetShared(true)
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	response := a.call("initialize", map[string]interface{}{
+		"capabilities": map[string]interface{}{"workspace": map[string]interface{}{"configuration": true}},
+	})
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	a.notify("initialized", map[string]interface{}{})
+	b.initialize(nil)
+
+	a.notify("workspace/didChangeConfiguration", map[string]interface{}{"settings": nil})
+	request := a.read()
+	if request.Method != "workspace/configuration" || request.ID == nil {
+		t.Fatalf("got %+v, want a workspace/configuration request", request)
+	}
+	answer := func(c *testClient, settings interface{}) {
+		message, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": request.ID, "result": []interface{}{settings}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(string(message))
+	}
+	// Another client answering in its place is ignored, and so is a
+	// duplicate answer
+	answer(b, nil)
+	answer(a, mockOptions(url.Values{"text": {"x"}}))
+	answer(a, nil)
+	if response := a.call("llm_flow/usage", nil); response.Error != nil {
+		t.Fatalf("usage: %v", response.Error)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		configured := 0
+		s.mu.Lock()
+		for _, c := range s.clients {
+			if c.config.configured() {
+				configured++
+			}
+		}
+		s.mu.Unlock()
+		if configured == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients configured, want the one asked", configured)
+		}
+	}
+}
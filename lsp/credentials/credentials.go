@@ -0,0 +1,232 @@
+// Package credentials resolves provider API keys from configurable sources.
+//
+// A source is written as a spec string:
+//
+//	env:NAME              environment variable NAME
+//	file:PATH             whole content of PATH
+//	file:PATH#NAME        NAME=value line of PATH
+//	cmd:COMMAND           stdout of COMMAND run by sh, e.g. "cmd:pass show codestral"
+//	key:VALUE             VALUE itself, which may contain "|"
+//
+// Several specs separated by "|" are tried in order. Resolved keys are
+// cached: file sources are re-read when the file changes and command
+// sources are re-run after a TTL, so keys can be rotated without a restart.
+package credentials
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandTTL is how long a key produced by a command is reused
+var CommandTTL = 5 * time.Minute
+
+const commandTimeout = 10 * time.Second
+
+// KeysPath is the default keys file with NAME=value lines
+func KeysPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "llm_flow", "keys")
+}
+
+// Default is the spec used when none is configured: the environment
+// variable, then the entry of the same name in the keys file
+func Default(envName string) string {
+	return "env:" + envName + "|file:" + KeysPath() + "#" + envName
+}
+
+// Resolver produces the current key for a spec
+type Resolver struct {
+	spec    string
+	sources []source
+}
+
+type source interface {
+	key() (string, error)
+}
+
+// Literal is the spec of a key given as is
+func Literal(key string) string {
+	return "key:" + key
+}
+
+// ReadsOnly reports whether spec reads nothing but the environment variables
+// envNames. Other variables may hold unrelated secrets, and files and
+// commands read the host, which only the user's own configuration may ask for.
+func ReadsOnly(spec string, envNames ...string) bool {
+	if strings.HasPrefix(spec, "key:") {
+		return true
+	}
+	for _, part := range strings.Split(spec, "|") {
+		kind, name, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if kind != "env" || !slices.Contains(envNames, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// New parses spec into a resolver
+func New(spec string) (*Resolver, error) {
+	r := &Resolver{spec: spec}
+	if key, ok := strings.CutPrefix(spec, "key:"); ok {
+		if key == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		r.spec = "key"
+		r.sources = []source{literalSource(key)}
+		return r, nil
+	}
+	for _, part := range strings.Split(spec, "|") {
+		kind, arg, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok || arg == "" {
+			return nil, fmt.Errorf("invalid credential source %q", part)
+		}
+		switch kind {
+		case "env":
+			r.sources = append(r.sources, envSource(arg))
+		case "file":
+			path, name, _ := strings.Cut(arg, "#")
+			r.sources = append(r.sources, &fileSource{path: expandHome(path), name: name})
+		case "cmd":
+			r.sources = append(r.sources, &commandSource{command: arg})
+		default:
+			return nil, fmt.Errorf("unknown credential source %q", kind)
+		}
+	}
+	return r, nil
+}
+
+// Key returns the key from the first source that has one
+func (r *Resolver) Key() (string, error) {
+	var errs []string
+	for _, s := range r.sources {
+		key, err := s.key()
+		if err == nil && key != "" {
+			return key, nil
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return "", fmt.Errorf("no key found in %s", r.spec)
+	}
+	return "", fmt.Errorf("no key found in %s: %s", r.spec, strings.Join(errs, "; "))
+}
+
+type literalSource string
+
+func (l literalSource) key() (string, error) {
+	return string(l), nil
+}
+
+type envSource string
+
+func (e envSource) key() (string, error) {
+	return os.Getenv(string(e)), nil
+}
+
+type fileSource struct {
+	path    string
+	name    string
+	mu      sync.Mutex
+	modTime time.Time
+	value   string
+}
+
+func (f *fileSource) key() (string, error) {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if info.ModTime().Equal(f.modTime) {
+		return f.value, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if f.name != "" {
+		value = lookup(data, f.name)
+	}
+	f.value, f.modTime = value, info.ModTime()
+	return value, nil
+}
+
+// lookup finds NAME=value in a keys file, ignoring blank lines and comments
+func lookup(data []byte, name string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(k) == name {
+			return strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+	return ""
+}
+
+type commandSource struct {
+	command string
+	mu      sync.Mutex
+	fetched time.Time
+	value   string
+}
+
+func (c *commandSource) key() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value != "" && time.Since(c.fetched) < CommandTTL {
+		return c.value, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%q failed: %v %s", c.command, err, strings.TrimSpace(stderr.String()))
+	}
+	// Tools like pass print the secret on the first line
+	value, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	c.value, c.fetched = strings.TrimSpace(value), time.Now()
+	return c.value, nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
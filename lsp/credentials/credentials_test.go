@@ -0,0 +1,81 @@
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys")
+	if err := os.WriteFile(keys, []byte("# keys\nA_KEY = \"from-file\"\n\nB_KEY=b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	whole := filepath.Join(dir, "whole")
+	if err := os.WriteFile(whole, []byte("  whole-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_TEST_SET", "from-env")
+	t.Setenv("CREDENTIALS_TEST_EMPTY", "")
+
+	tests := []struct {
+		name string
+		spec string
+		want string
+		// err is set when no key is found or the spec is invalid
+		err bool
+	}{
+		{name: "env", spec: "env:CREDENTIALS_TEST_SET", want: "from-env"},
+		{name: "empty env", spec: "env:CREDENTIALS_TEST_EMPTY", err: true},
+		{name: "file entry", spec: "file:" + keys + "#A_KEY", want: "from-file"},
+		{name: "whole file", spec: "file:" + whole, want: "whole-file"},
+		{name: "missing file", spec: "file:" + filepath.Join(dir, "none"), err: true},
+		{name: "command", spec: "cmd:printf 'secret\\nuser: me\\n'", want: "secret"},
+		{name: "failing command", spec: "cmd:exit 1", err: true},
+		{name: "literal", spec: "key:a|b", want: "a|b"},
+		{name: "fallback", spec: "env:CREDENTIALS_TEST_EMPTY | file:" + keys + "#B_KEY", want: "b"},
+		{name: "first wins", spec: "env:CREDENTIALS_TEST_SET|file:" + keys + "#B_KEY", want: "from-env"},
+		{name: "fallback after error", spec: "cmd:exit 1|env:CREDENTIALS_TEST_SET", want: "from-env"},
+		{name: "unknown source", spec: "vault:x", err: true},
+		{name: "empty source", spec: "env:", err: true},
+		{name: "empty literal", spec: "key:", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.spec)
+			var got string
+			if err == nil {
+				got, err = r.Key()
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadsOnly(t *testing.T) {
+	tests := []struct {
+		spec string
+		want bool
+	}{
+		{spec: "key:abc", want: true},
+		{spec: "key:env:X|cmd:y", want: true},
+		{spec: "env:CODESTRAL_API_KEY", want: true},
+		{spec: "env:CODESTRAL_API_KEY | env:CODESTRAL_API_KEY", want: true},
+		{spec: "env:AWS_SECRET_ACCESS_KEY", want: false},
+		{spec: "env:CODESTRAL_API_KEY|env:HOME", want: false},
+		{spec: "file:~/.ssh/id_rsa", want: false},
+		{spec: "env:CODESTRAL_API_KEY|cmd:curl evil", want: false},
+		{spec: "cmd:pass show codestral", want: false},
+	}
+	for _, tt := range tests {
+		if got := ReadsOnly(tt.spec, "CODESTRAL_API_KEY"); got != tt.want {
+			t.Errorf("ReadsOnly(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/document"
+	"github.com/festeh/llm_flow/lsp/telemetry"
+)
+
+// maxConcurrentRequests bounds the requests of one connection being handled
+// at once; the rest wait for a slot, still cancellable
+const maxConcurrentRequests = 8
+
+// How many notifications may wait behind a slow one before reading blocks
+const notificationBacklog = 256
+
+// promptMethods are handled as soon as they are read, ahead of queued
+// notifications: they are cheap, and requests read after them must see
+// their effect
+var promptMethods = map[string]bool{
+	"$/cancelRequest":        true,
+	"cancel_predict_editor":  true,
+	"textDocument/didOpen":   true,
+	"textDocument/didChange": true,
+	"textDocument/didSave":   true,
+	"textDocument/didClose":  true,
+}
+
+// connection is the client a message came from, with the state of its
+// session. Clients of a shared server each initialize, configure and shut
+// down their own session.
+type connection struct {
+	writeMu sync.Mutex
+	w       io.Writer
+	// close ends the connection
+	close       context.CancelFunc
+	initialized atomic.Bool
+	shutdown    atomic.Bool
+	config      *Config
+
+	mu sync.Mutex
+	// encoding is the position encoding negotiated in initialize
+	encoding string
+	// capabilities are those the client announced in initialize
+	capabilities     ClientCapabilities
+	workspaceFolders []WorkspaceFolder
+	// folderConfigs holds settings scoped to a workspace folder, by path
+	folderConfigs map[string]*Config
+	// documents holds the URIs of the documents the client has open
+	documents map[string]bool
+	// requests cancels in-flight requests on $/cancelRequest
+	requests map[ID]context.CancelFunc
+	// predictions awaits shown/accepted/rejected feedback
+	predictions map[ID]telemetry.Event
+	// calls awaits the responses to requests sent to the client
+	calls    map[ID]chan Header
+	nextCall int64
+}
+
+func newConnection(w io.Writer, close context.CancelFunc) *connection {
+	return &connection{
+		w:             w,
+		close:         close,
+		config:        &Config{},
+		folderConfigs: make(map[string]*Config),
+		documents:     make(map[string]bool),
+		requests:      make(map[ID]context.CancelFunc),
+		predictions:   make(map[ID]telemetry.Event),
+		calls:         make(map[ID]chan Header),
+	}
+}
+
+// folders returns the workspace folders the client opened
+func (c *connection) folders() []WorkspaceFolder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.workspaceFolders
+}
+
+// cancelAll cancels the requests in flight
+func (c *connection) cancelAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, cancel := range c.requests {
+		cancel()
+		delete(c.requests, id)
+	}
+}
+
+// opened marks uri open, reporting whether it was already
+func (c *connection) opened(uri string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	open := c.documents[uri]
+	c.documents[uri] = true
+	return open
+}
+
+// closed marks uri closed, reporting whether it was open
+func (c *connection) closed(uri string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	open := c.documents[uri]
+	delete(c.documents, uri)
+	return open
+}
+
+// closeDocuments closes the documents the client left open
+func (s *Server) closeDocuments(c *connection) {
+	c.mu.Lock()
+	documents := c.documents
+	c.documents = make(map[string]bool)
+	c.mu.Unlock()
+	for uri := range documents {
+		s.documents.Close(uri)
+	}
+}
+
+// closeConfigs releases the providers the client configured
+func (c *connection) closeConfigs() {
+	c.mu.Lock()
+	folderConfigs := c.folderConfigs
+	c.folderConfigs = make(map[string]*Config)
+	c.mu.Unlock()
+	for _, cfg := range folderConfigs {
+		cfg.Close()
+	}
+	c.config.Close()
+}
+
+type connKey struct{}
+
+// connFrom returns the connection of ctx, or the server's default one
+func (s *Server) connFrom(ctx context.Context) *connection {
+	if c, ok := ctx.Value(connKey{}).(*connection); ok {
+		return c
+	}
+	return s.out
+}
+
+// dispatcher handles the messages of one connection. Notifications run in
+// order on a goroutine of their own, requests concurrently on at most
+// maxConcurrentRequests goroutines.
+type dispatcher struct {
+	s             *Server
+	ctx           context.Context
+	notifications chan Header
+	slots         chan struct{}
+	wg            sync.WaitGroup
+}
+
+func (s *Server) newDispatcher(ctx context.Context) *dispatcher {
+	d := &dispatcher{
+		s:             s,
+		ctx:           ctx,
+		notifications: make(chan Header, notificationBacklog),
+		slots:         make(chan struct{}, maxConcurrentRequests),
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for header := range d.notifications {
+			d.handle(d.ctx, header)
+		}
+	}()
+	return d
+}
+
+// dispatch hands a message over without waiting for requests or queued
+// notifications to be handled
+func (d *dispatcher) dispatch(message []byte) {
+	header, err := d.s.decodeMessage(d.ctx, message)
+	if err != nil {
+		log.FromContext(d.ctx).Error("Error handling message", "error", err)
+		return
+	}
+	switch {
+	case header.Method == "":
+		d.s.handleCallResponse(d.ctx, *header)
+	case header.ID == nil && promptMethods[header.Method]:
+		d.handle(d.ctx, *header)
+	case header.ID == nil:
+		d.notifications <- *header
+	case header.Method == "initialize":
+		// Nothing may be sent before its result, but clients that pipeline
+		// anyway should find the server initialized
+		ctx, done := d.s.trackRequest(d.ctx, *header.ID)
+		d.handle(ctx, *header)
+		done()
+	default:
+		// Tracked right away so that cancelling a waiting request works
+		ctx, done := d.s.trackRequest(d.s.pin(d.ctx, header.Params), *header.ID)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			defer done()
+			select {
+			case d.slots <- struct{}{}:
+			case <-ctx.Done():
+				d.s.sendError(ctx, header.ID, newError(RequestCancelled, "request cancelled"))
+				return
+			}
+			defer func() { <-d.slots }()
+			d.handle(ctx, *header)
+		}()
+	}
+}
+
+type pinnedKey struct{}
+
+// pin keeps the snapshot of the document a request is about as it was when
+// the request was read, since changes read later are applied before the
+// request runs
+func (s *Server) pin(ctx context.Context, params json.RawMessage) context.Context {
+	var target struct {
+		URI          string                 `json:"uri"`
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+	if json.Unmarshal(params, &target) != nil {
+		return ctx
+	}
+	uri := target.TextDocument.URI
+	if uri == "" {
+		uri = target.URI
+	}
+	doc, ok := s.documents.Get(uri)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, pinnedKey{}, doc)
+}
+
+// snapshot returns the document at uri as the request of ctx saw it
+func (s *Server) snapshot(ctx context.Context, uri string) (*document.Snapshot, bool) {
+	if doc, ok := ctx.Value(pinnedKey{}).(*document.Snapshot); ok && doc.URI == uri {
+		return doc, true
+	}
+	return s.documents.Get(uri)
+}
+
+func (d *dispatcher) handle(ctx context.Context, header Header) {
+	err := d.s.handle(ctx, header)
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		log.FromContext(ctx).Info("Request cancelled", "method", header.Method)
+	default:
+		log.FromContext(ctx).Error("Error handling message", "method", header.Method, "error", err)
+	}
+}
+
+// close stops taking messages and waits for the ones being handled
+func (d *dispatcher) close() {
+	close(d.notifications)
+	d.wg.Wait()
+}
@@ -0,0 +1,422 @@
+// Package document keeps the text of open documents. Each version is an
+// immutable Snapshot indexed by line, so predictions in flight keep the text
+// they started from while edits come in.
+package document
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Position encodings, the unit a character offset counts in
+const (
+	UTF8  = "utf-8"
+	UTF16 = "utf-16"
+	UTF32 = "utf-32"
+)
+
+// Snapshot is one version of a document. Its lines are kept in blocks, which
+// snapshots share, so that an edit rebuilds only the blocks it touches and
+// the text is only joined when asked for.
+type Snapshot struct {
+	URI        string
+	LanguageID string
+	Version    int
+	blocks     []*block
+	// firstLines and offsets hold the line and byte offset each block
+	// starts at
+	firstLines []int
+	offsets    []int
+	lineCount  int
+	size       int
+	textOnce   sync.Once
+	text       string
+	// history holds the last changes that led to this version, oldest first
+	history []Change
+}
+
+// blockLines is the most lines a block holds
+const blockLines = 256
+
+// block holds consecutive lines of a document without their line breaks
+type block struct {
+	lines []string
+	// starts holds the byte offset each line starts at within the block
+	starts []int
+	// size counts a line break after every line
+	size int
+}
+
+func newBlock(lines []string) *block {
+	b := &block{lines: lines, starts: make([]int, len(lines))}
+	for i, line := range lines {
+		b.starts[i] = b.size
+		b.size += len(line) + 1
+	}
+	return b
+}
+
+// chunk cuts lines into blocks
+func chunk(lines []string) []*block {
+	blocks := make([]*block, 0, len(lines)/blockLines+1)
+	for i := 0; i < len(lines); i += blockLines {
+		blocks = append(blocks, newBlock(lines[i:min(i+blockLines, len(lines))]))
+	}
+	return blocks
+}
+
+// maxHistory is the number of changes a snapshot remembers
+const maxHistory = 16
+
+// Change is an edit in the history of a document, as the lines it touched
+// before and after it
+type Change struct {
+	Version int
+	// Line is the first line the change touched
+	Line   int
+	Before string
+	After  string
+	// start and end delimit the edited bytes after the change, so that the
+	// keystrokes of one edit are merged into a single change
+	start, end int
+}
+
+// New indexes text as the given version of the document at uri
+func New(uri, languageID string, version int, text string) *Snapshot {
+	s := newSnapshot(uri, languageID, version, chunk(strings.Split(text, "\n")))
+	s.textOnce.Do(func() { s.text = text })
+	return s
+}
+
+func newSnapshot(uri, languageID string, version int, blocks []*block) *Snapshot {
+	s := &Snapshot{
+		URI:        uri,
+		LanguageID: languageID,
+		Version:    version,
+		blocks:     blocks,
+		firstLines: make([]int, len(blocks)),
+		offsets:    make([]int, len(blocks)),
+	}
+	for i, b := range blocks {
+		s.firstLines[i] = s.lineCount
+		s.offsets[i] = s.size
+		s.lineCount += len(b.lines)
+		s.size += b.size
+	}
+	// The last line has no line break
+	s.size--
+	return s
+}
+
+func (s *Snapshot) Text() string {
+	s.textOnce.Do(func() {
+		var b strings.Builder
+		b.Grow(s.size)
+		for i, block := range s.blocks {
+			for j, line := range block.lines {
+				if i > 0 || j > 0 {
+					b.WriteByte('\n')
+				}
+				b.WriteString(line)
+			}
+		}
+		s.text = b.String()
+	})
+	return s.text
+}
+
+// LineCount is the number of lines, counting the empty one after a final
+// newline
+func (s *Snapshot) LineCount() int {
+	return s.lineCount
+}
+
+// locate returns the block holding line i and the index of the line in it
+func (s *Snapshot) locate(i int) (int, int) {
+	b := sort.Search(len(s.firstLines), func(j int) bool { return s.firstLines[j] > i }) - 1
+	return b, i - s.firstLines[b]
+}
+
+// rawLine returns line i with a carriage return it may end with
+func (s *Snapshot) rawLine(i int) string {
+	b, k := s.locate(i)
+	return s.blocks[b].lines[k]
+}
+
+// lineStart returns the byte offset line i starts at
+func (s *Snapshot) lineStart(i int) int {
+	b, k := s.locate(i)
+	return s.offsets[b] + s.blocks[b].starts[k]
+}
+
+// lineAt returns the line of a byte offset, which must be in range
+func (s *Snapshot) lineAt(offset int) int {
+	b := sort.Search(len(s.offsets), func(j int) bool { return s.offsets[j] > offset }) - 1
+	starts := s.blocks[b].starts
+	k := sort.Search(len(starts), func(j int) bool { return starts[j] > offset-s.offsets[b] }) - 1
+	return s.firstLines[b] + k
+}
+
+// slice returns the text from byte start to end, which must be in range
+func (s *Snapshot) slice(start, end int) string {
+	var b strings.Builder
+	line := s.lineAt(start)
+	for offset := start; offset < end; line++ {
+		lineStart := s.lineStart(line)
+		raw := s.rawLine(line)
+		to := min(end-lineStart, len(raw))
+		b.WriteString(raw[offset-lineStart : to])
+		offset = lineStart + to
+		if offset < end {
+			b.WriteByte('\n')
+			offset++
+		}
+	}
+	return b.String()
+}
+
+// Line returns line i without its line break
+func (s *Snapshot) Line(i int) string {
+	return strings.TrimSuffix(s.rawLine(i), "\r")
+}
+
+// Offset converts a line and character in encoding units to a byte offset.
+// Characters past the end of the line point to its end.
+func (s *Snapshot) Offset(line, character int, encoding string) (int, error) {
+	if line < 0 || line >= s.lineCount {
+		return 0, fmt.Errorf("line number out of range: %d", line)
+	}
+	return s.lineStart(line) + byteOffset(s.Line(line), character, encoding), nil
+}
+
+// Position converts a byte offset to a line and character in encoding units
+func (s *Snapshot) Position(offset int, encoding string) (line, character int) {
+	offset = min(max(offset, 0), s.size)
+	line = s.lineAt(offset)
+	return line, characterOffset(s.Line(line), offset-s.lineStart(line), encoding)
+}
+
+// Edit returns the given version of the document with the bytes from start
+// to end replaced by text. Only the blocks holding the lines of the edit are
+// rebuilt, the others are shared with s.
+func (s *Snapshot) Edit(start, end int, text string, version int) (*Snapshot, error) {
+	if start < 0 || end < start || end > s.size {
+		return nil, fmt.Errorf("edit %d-%d out of range", start, end)
+	}
+	first, last := s.lineAt(start), s.lineAt(end)
+	before := s.rawLine(first)[:start-s.lineStart(first)]
+	after := s.rawLine(last)[end-s.lineStart(last):]
+	replaced := strings.Split(before+text+after, "\n")
+
+	firstBlock, firstIndex := s.locate(first)
+	lastBlock, lastIndex := s.locate(last)
+	lines := s.blocks[lastBlock].lines
+	region := make([]string, 0, firstIndex+len(replaced)+len(lines)-lastIndex)
+	region = append(region, s.blocks[firstBlock].lines[:firstIndex]...)
+	region = append(region, replaced...)
+	region = append(region, lines[lastIndex+1:]...)
+	// Small leftovers join the next block so that blocks stay large
+	if len(region) < blockLines/2 && lastBlock+1 < len(s.blocks) {
+		lastBlock++
+		region = append(region, s.blocks[lastBlock].lines...)
+	}
+	blocks := make([]*block, 0, len(s.blocks)+len(region)/blockLines)
+	blocks = append(blocks, s.blocks[:firstBlock]...)
+	blocks = append(blocks, chunk(region)...)
+	blocks = append(blocks, s.blocks[lastBlock+1:]...)
+
+	next := newSnapshot(s.URI, s.LanguageID, version, blocks)
+	next.history = s.record(next, start, end, text)
+	return next, nil
+}
+
+// Replace returns the given version of the document with text as its
+// content. Only the part that differs is recorded in the history.
+func (s *Snapshot) Replace(text string, version int) *Snapshot {
+	old := s.Text()
+	prefix := 0
+	for prefix < len(old) && prefix < len(text) && old[prefix] == text[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(text)-prefix && old[len(old)-1-suffix] == text[len(text)-1-suffix] {
+		suffix++
+	}
+	next, _ := s.Edit(prefix, len(old)-suffix, text[prefix:len(text)-suffix], version)
+	return next
+}
+
+// History returns the last changes that led to this version, oldest first
+func (s *Snapshot) History() []Change {
+	return s.history
+}
+
+// record returns the history of next, the result of replacing the bytes
+// from start to end of s by text
+func (s *Snapshot) record(next *Snapshot, start, end int, text string) []Change {
+	if s.slice(start, end) == text {
+		return s.history
+	}
+	history := make([]Change, 0, maxHistory)
+	if n := len(s.history); n > 0 {
+		last := s.history[n-1]
+		if start >= last.start && end <= last.end {
+			// Another keystroke within the last change
+			history = append(history, s.history[:n-1]...)
+			last.Version = next.Version
+			last.end += len(text) - (end - start)
+			_, last.After = next.lineSpan(last.start, last.end)
+			if last.After != last.Before {
+				history = append(history, last)
+			}
+			return history
+		}
+		history = append(history, s.history[max(0, n-maxHistory+1):]...)
+	}
+	line, before := s.lineSpan(start, end)
+	_, after := next.lineSpan(start, start+len(text))
+	return append(history, Change{
+		Version: next.Version,
+		Line:    line,
+		Before:  before,
+		After:   after,
+		start:   start,
+		end:     start + len(text),
+	})
+}
+
+// lineSpan returns the first line of the bytes from start to end and the
+// text of all the lines they are on
+func (s *Snapshot) lineSpan(start, end int) (int, string) {
+	first := s.lineAt(start)
+	if end > start && s.slice(end-1, end) == "\n" {
+		// The line break ends the span rather than starting another line
+		end--
+	}
+	last := s.lineAt(end)
+	lines := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		lines = append(lines, s.rawLine(i))
+	}
+	return first, strings.Join(lines, "\n")
+}
+
+// byteOffset converts a character offset in encoding units into a byte
+// offset into line. Offsets past the end of the line are clamped to it, and
+// offsets inside a character point to its start.
+func byteOffset(line string, character int, encoding string) int {
+	if encoding == UTF8 {
+		offset := min(max(character, 0), len(line))
+		for offset < len(line) && !utf8.RuneStart(line[offset]) {
+			offset--
+		}
+		return offset
+	}
+	units := 0
+	for i, r := range line {
+		width := runeUnits(r, encoding)
+		if units+width > character {
+			return i
+		}
+		units += width
+	}
+	return len(line)
+}
+
+// characterOffset converts a byte offset into line into encoding units
+func characterOffset(line string, offset int, encoding string) int {
+	offset = min(max(offset, 0), len(line))
+	if encoding == UTF8 {
+		return offset
+	}
+	units := 0
+	for _, r := range line[:offset] {
+		units += runeUnits(r, encoding)
+	}
+	return units
+}
+
+// runeUnits is the number of code units r takes in encoding; invalid bytes,
+// decoded as utf8.RuneError, count as one
+func runeUnits(r rune, encoding string) int {
+	if encoding == UTF16 && r > 0xFFFF {
+		return 2
+	}
+	return 1
+}
+
+type entry struct {
+	snapshot *Snapshot
+	// opens counts the clients that have the document open, as editors
+	// sharing a daemon open the same files
+	opens int
+}
+
+// Store holds the latest snapshot of every open document
+type Store struct {
+	mu   sync.RWMutex
+	docs map[string]*entry
+}
+
+func NewStore() *Store {
+	return &Store{docs: make(map[string]*entry)}
+}
+
+// Open starts tracking a document, or replaces its text if another client
+// has it open already
+func (s *Store) Open(snapshot *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.docs[snapshot.URI]
+	if !ok {
+		e = &entry{}
+		s.docs[snapshot.URI] = e
+	}
+	e.snapshot = snapshot
+	e.opens++
+}
+
+// Close forgets a document once every client that opened it closed it
+func (s *Store) Close(uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.docs[uri]
+	if !ok {
+		return
+	}
+	e.opens--
+	if e.opens <= 0 {
+		delete(s.docs, uri)
+	}
+}
+
+// Get returns the latest snapshot of an open document
+func (s *Store) Get(uri string) (*Snapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.docs[uri]
+	if !ok {
+		return nil, false
+	}
+	return e.snapshot, true
+}
+
+// Update replaces the snapshot of an open document with the one edit
+// derives from it
+func (s *Store) Update(uri string, edit func(*Snapshot) (*Snapshot, error)) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.docs[uri]
+	if !ok {
+		return nil, fmt.Errorf("document not open: %s", uri)
+	}
+	snapshot, err := edit(e.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	e.snapshot = snapshot
+	return snapshot, nil
+}
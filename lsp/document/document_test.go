@@ -0,0 +1,85 @@
+package document
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestEdit checks snapshots against the plain text they should hold across
+// random edits of a document spanning many blocks
+func TestEdit(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	pieces := []string{"", "a", "é", "😀", "\n", "\r\n", "x\ny", "\n\n\n", strings.Repeat("line\n", blockLines)}
+	var b strings.Builder
+	for i := 0; i < 3*blockLines; i++ {
+		b.WriteString("func f() {}\n")
+	}
+	text := b.String()
+	doc := New("file:///a.go", "go", 0, text)
+	for version := 1; version <= 2000; version++ {
+		start := rng.Intn(len(text) + 1)
+		end := start + rng.Intn(min(len(text)-start, 3*blockLines)+1)
+		if rng.Intn(10) == 0 {
+			end = start + rng.Intn(len(text)-start+1)
+		}
+		// Clients edit whole characters
+		for start < len(text) && !utf8.RuneStart(text[start]) {
+			start++
+		}
+		end = max(start, end)
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+		insert := pieces[rng.Intn(len(pieces))]
+		next, err := doc.Edit(start, end, insert, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text = text[:start] + insert + text[end:]
+		doc = next
+		lines := strings.Split(text, "\n")
+		if doc.LineCount() != len(lines) {
+			t.Fatalf("version %d: %d lines, want %d", version, doc.LineCount(), len(lines))
+		}
+		for _, i := range []int{0, rng.Intn(len(lines)), len(lines) - 1} {
+			if got := doc.Line(i); got != strings.TrimSuffix(lines[i], "\r") {
+				t.Fatalf("version %d: line %d is %q, want %q", version, i, got, lines[i])
+			}
+			offset, err := doc.Offset(i, 0, UTF8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(strings.Join(lines[:i], "\n")) + min(i, 1); offset != want {
+				t.Fatalf("version %d: line %d starts at %d, want %d", version, i, offset, want)
+			}
+			if line, _ := doc.Position(offset, UTF8); line != i {
+				t.Fatalf("version %d: offset %d is on line %d, want %d", version, offset, line, i)
+			}
+		}
+		if version%100 == 0 && doc.Text() != text {
+			t.Fatalf("version %d: text differs", version)
+		}
+	}
+	if doc.Text() != text {
+		t.Fatal("text differs")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	doc := New("file:///a.go", "go", 0, "a\nb\nc\n")
+	for i, r := range "xyz" {
+		var err error
+		if doc, err = doc.Edit(2+i, 2+i, string(r), i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := doc.History()
+	if len(history) != 1 {
+		t.Fatalf("got %d changes, want the keystrokes merged into 1", len(history))
+	}
+	if change := history[0]; change.Line != 1 || change.Before != "b" || change.After != "xyzb" || change.Version != 3 {
+		t.Errorf("got %+v", change)
+	}
+}
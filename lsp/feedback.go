@@ -0,0 +1,90 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/telemetry"
+)
+
+// Predictions older than this are dropped without an outcome
+const feedbackWindow = 10 * time.Minute
+
+type FeedbackParams struct {
+	ID             ID  `json:"id"`
+	AcceptedLength int `json:"acceptedLength"`
+}
+
+// SetTelemetry enables recording prediction outcomes to store
+func (s *Server) SetTelemetry(store *telemetry.Store) {
+	s.telemetry = store
+}
+
+// recordPrediction remembers a finished prediction so that a later
+// shown/accepted/rejected notification can be attributed to it
+func (s *Server) recordPrediction(ctx context.Context, id ID, uri string, route Route, content string, latency time.Duration) {
+	if s.telemetry == nil {
+		return
+	}
+	rawID, _ := json.Marshal(id)
+	event := telemetry.Event{
+		Time:      time.Now(),
+		Kind:      telemetry.Predicted,
+		ID:        rawID,
+		Provider:  route.Provider.Name(),
+		Model:     route.Model,
+		Language:  s.language(uri),
+		LatencyMs: latency.Milliseconds(),
+		Length:    len(content),
+	}
+	if err := s.telemetry.Record(event); err != nil {
+		log.FromContext(ctx).Error("Telemetry", "error", err)
+	}
+
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.predictions {
+		if time.Since(e.Time) > feedbackWindow {
+			delete(c.predictions, k)
+		}
+	}
+	c.predictions[id] = event
+}
+
+// HandlePredictionFeedback handles predict_editor/shown, predict_editor/accepted
+// and predict_editor/rejected notifications
+func (s *Server) HandlePredictionFeedback(ctx context.Context, kind string, params json.RawMessage) error {
+	var feedback FeedbackParams
+	if err := decodeParams(params, &feedback); err != nil {
+		return err
+	}
+	if s.telemetry == nil {
+		return nil
+	}
+
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	event, ok := c.predictions[feedback.ID]
+	if ok && kind != telemetry.Shown {
+		delete(c.predictions, feedback.ID)
+	}
+	c.mu.Unlock()
+	if !ok {
+		log.FromContext(ctx).Warn("Feedback for unknown prediction", "id", feedback.ID.String(), "kind", kind)
+		return nil
+	}
+
+	event.Time = time.Now()
+	event.Kind = kind
+	if kind == telemetry.Accepted {
+		event.AcceptedLength = feedback.AcceptedLength
+		if event.AcceptedLength == 0 {
+			event.AcceptedLength = event.Length
+		}
+	}
+	log.FromContext(ctx).Info("Feedback", "id", feedback.ID.String(), "kind", kind, "accepted", event.AcceptedLength)
+	return s.telemetry.Record(event)
+}
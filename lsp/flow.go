@@ -9,19 +9,55 @@ import (
 	"github.com/charmbracelet/log"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/festeh/llm_flow/lsp/logging"
 	"github.com/festeh/llm_flow/lsp/provider"
 	"github.com/festeh/llm_flow/lsp/splitter"
+	"github.com/festeh/llm_flow/lsp/usage"
 )
 
-func Flow(p provider.Provider, prefixSuffix splitter.ProjectContext, ctx context.Context, w io.Writer) (string, error) {
+// FlowTrace captures what was exchanged with the provider during a flow
+type FlowTrace struct {
+	Request  map[string]interface{}
+	Response bytes.Buffer
+	// Usage as reported by the provider, nil if it didn't
+	Usage *usage.Tokens
+	// FirstToken is the time from sending the request to the first streamed
+	// content, or to the full response when not streaming
+	FirstToken time.Duration
+}
+
+// StatusError is returned when the provider answers with an HTTP error
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is the delay asked for by the provider, if any
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("provider returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+func Flow(p provider.Provider, prefixSuffix splitter.ProjectContext, sampling provider.Sampling, ctx context.Context, w io.Writer) (string, error) {
+	return TracedFlow(p, prefixSuffix, sampling, ctx, w, nil)
+}
+
+// TracedFlow is Flow that also fills trace with the request body and raw response
+func TracedFlow(p provider.Provider, prefixSuffix splitter.ProjectContext, sampling provider.Sampling, ctx context.Context, w io.Writer, trace *FlowTrace) (string, error) {
 
 	var buffer strings.Builder
-	reqBody, err := p.GetRequestBody(prefixSuffix)
+	reqBody, err := p.GetRequestBody(prefixSuffix, sampling)
 	if err != nil {
 		return "", fmt.Errorf("error getting request body: %v", err)
 	}
+	if trace != nil {
+		trace.Request = reqBody
+	}
+	logger := log.FromContext(ctx)
 
 	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
@@ -33,39 +69,77 @@ func Flow(p provider.Provider, prefixSuffix splitter.ProjectContext, ctx context
 		return "", fmt.Errorf("error creating request: %v", err)
 	}
 
+	auth, err := p.GetAuthHeader()
+	if err != nil {
+		return "", fmt.Errorf("error getting API key: %v", err)
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", p.GetAuthHeader())
+	req.Header.Set("Authorization", auth)
 
 	client := &http.Client{}
-	log.Info("Sending request...")
+	logging.Trace(ctx, "Sending request", "body", string(jsonBody))
+	logger.Debug("Sending request", "endpoint", p.Endpoint())
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("error making request: %v", err)
 	}
 	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if trace != nil {
+		body = io.TeeReader(resp.Body, &trace.Response)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", newStatusError(resp, body)
+	}
+	var tokens *usage.Tokens
+	var firstToken time.Duration
 	if p.IsStreaming() {
-		if err := handleStreamingResponse(ctx, resp.Body, &buffer); err != nil {
-			return "", err
-		}
+		tokens, err = handleStreamingResponse(ctx, body, &buffer, w, func() {
+			firstToken = time.Since(start)
+		})
 	} else {
-		if err := handleNonStreamingResponse(resp.Body, &buffer, p); err != nil {
-			return "", err
+		tokens, err = handleNonStreamingResponse(ctx, body, &buffer, p)
+		firstToken = time.Since(start)
+		if err == nil {
+			io.WriteString(w, buffer.String())
 		}
 	}
+	if trace != nil {
+		trace.FirstToken = firstToken
+	}
+	if err != nil {
+		return "", err
+	}
+	if trace != nil {
+		trace.Usage = tokens
+	}
 
 	res := buffer.String()
-	log.Debug("Done", "result", res)
+	logging.Trace(ctx, "Done", "result", res)
 	return res, nil
 }
 
-func handleStreamingResponse(ctx context.Context, body io.ReadCloser, buffer *strings.Builder) error {
+func newStatusError(resp *http.Response, body io.Reader) *StatusError {
+	text, _ := io.ReadAll(io.LimitReader(body, 1024))
+	e := &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(text))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// handleStreamingResponse copies the content to w as it arrives, and calls
+// onFirst when the first content arrives
+func handleStreamingResponse(ctx context.Context, body io.Reader, buffer *strings.Builder, w io.Writer, onFirst func()) (*usage.Tokens, error) {
+	var tokens *usage.Tokens
 	scanner := bufio.NewScanner(body)
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
-			log.Info("Flow is cancelled")
-			return ctx.Err()
+			log.FromContext(ctx).Debug("Flow is cancelled")
+			return nil, ctx.Err()
 		default:
 			line := scanner.Text()
 			if !strings.HasPrefix(line, "data: ") {
@@ -81,33 +155,52 @@ func handleStreamingResponse(ctx context.Context, body io.ReadCloser, buffer *st
 						Content string `json:"content"`
 					} `json:"delta"`
 				} `json:"choices"`
+				// Sent with the last chunk by providers that report it
+				Usage *usage.Tokens `json:"usage"`
 			}
 			if err := json.Unmarshal([]byte(content), &streamResp); err != nil {
-				return fmt.Errorf("error parsing response: %v", err)
+				return nil, fmt.Errorf("error parsing response: %v", err)
+			}
+			if streamResp.Usage != nil {
+				tokens = streamResp.Usage
+			}
+			if len(streamResp.Choices) == 0 {
+				continue
 			}
 			choice := streamResp.Choices[0].Delta.Content
+			if buffer.Len() == 0 && choice != "" {
+				onFirst()
+			}
 			buffer.WriteString(choice)
+			io.WriteString(w, choice)
 		}
 	}
-	return scanner.Err()
+	return tokens, scanner.Err()
 }
 
-func handleNonStreamingResponse(body io.ReadCloser, buffer *strings.Builder, p provider.Provider) error {
+func handleNonStreamingResponse(ctx context.Context, body io.Reader, buffer *strings.Builder, p provider.Provider) (*usage.Tokens, error) {
 	bodyBytes, err := io.ReadAll(body)
 	if err != nil {
-		return fmt.Errorf("error reading response: %v", err)
+		return nil, fmt.Errorf("error reading response: %v", err)
 	}
 	response := p.NewResponse()
 	if err := json.Unmarshal(bodyBytes, &response); err != nil {
-		log.Error("Error", "body", string(bodyBytes))
-		return fmt.Errorf("error parsing response: %v", err)
+		log.FromContext(ctx).Error("Unexpected response", "error", err)
+		logging.Trace(ctx, "Unexpected response", "body", string(bodyBytes))
+		return nil, fmt.Errorf("error parsing response: %v", err)
 	}
 	err = response.Validate()
 	if err != nil {
-		log.Error("Error validating", "body", string(bodyBytes))
-		return fmt.Errorf("error validating response: %v", err)
+		log.FromContext(ctx).Error("Invalid response", "error", err)
+		logging.Trace(ctx, "Invalid response", "body", string(bodyBytes))
+		return nil, fmt.Errorf("error validating response: %v", err)
 	}
-	log.Info("", "Result", response.GetResult())
 	buffer.WriteString(response.GetResult())
-	return nil
+
+	// Not every provider reports usage, and some answer with a JSON array
+	var withUsage struct {
+		Usage *usage.Tokens `json:"usage"`
+	}
+	json.Unmarshal(bodyBytes, &withUsage)
+	return withUsage.Usage, nil
 }
@@ -0,0 +1,101 @@
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// JSON-RPC and LSP error codes
+const (
+	ParseError           = -32700
+	InvalidRequest       = -32600
+	MethodNotFound       = -32601
+	InvalidParams        = -32602
+	InternalError        = -32603
+	ServerNotInitialized = -32002
+	RequestCancelled     = -32800
+)
+
+// ID is a JSON-RPC request id, which clients may send as a number or a string
+type ID struct {
+	Num      int64
+	Str      string
+	IsString bool
+}
+
+// NumberID makes an id for server-initiated requests
+func NumberID(n int64) ID {
+	return ID{Num: n}
+}
+
+func (id ID) String() string {
+	if id.IsString {
+		return id.Str
+	}
+	return strconv.FormatInt(id.Num, 10)
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if id.IsString {
+		return json.Marshal(id.Str)
+	}
+	return json.Marshal(id.Num)
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*id = ID{IsString: true}
+		return json.Unmarshal(data, &id.Str)
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("id must be a number or a string")
+	}
+	num, err := n.Int64()
+	if err != nil {
+		return fmt.Errorf("id must be an integer: %s", n)
+	}
+	*id = ID{Num: num}
+	return nil
+}
+
+// ResponseError is the error member of a response. Handlers return it to
+// pick the error code; other errors are reported as InternalError.
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+func newError(code int, format string, args ...interface{}) *ResponseError {
+	return &ResponseError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// decodeParams unmarshals params into v, reporting failures as InvalidParams.
+// Missing params leave v untouched.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	trimmed := bytes.TrimSpace(params)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil
+	}
+	if err := json.Unmarshal(trimmed, v); err != nil {
+		return newError(InvalidParams, "invalid params: %v", err)
+	}
+	return nil
+}
+
+// sendError answers the request id with an error; a nil id is sent as null
+// for messages whose id could not be read
+func (s *Server) sendError(ctx context.Context, id *ID, err *ResponseError) error {
+	return s.sendResponse(ctx, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error":   err,
+	})
+}
@@ -0,0 +1,122 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How long shutdown waits for in-flight completions before cancelling them
+const drainTimeout = 3 * time.Second
+
+// Shutdown handles the LSP shutdown request: new predictions are refused and
+// in-flight ones get drainTimeout to finish before they are cancelled
+func (s *Server) Shutdown(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	logger.Info("Shutdown request received")
+	s.connFrom(ctx).shutdown.Store(true)
+	if s.shared {
+		// Other editors keep using the daemon
+		return nil
+	}
+	s.flowsMu.Lock()
+	s.shutdown.Store(true)
+	s.flowsMu.Unlock()
+	if !s.drain(drainTimeout) {
+		logger.Warn("Cancelling in-flight requests", "after", drainTimeout)
+		s.cancelAll()
+		s.drain(time.Second)
+	}
+	return nil
+}
+
+// Exit handles the LSP exit notification. The server stops serving, and
+// ExitCode is 0 only if shutdown came first. A shared server only closes the
+// client's connection.
+func (s *Server) Exit(ctx context.Context) error {
+	if s.shared {
+		log.FromContext(ctx).Info("Exit notification received, closing connection")
+		if c := s.connFrom(ctx); c.close != nil {
+			c.close()
+		}
+		return nil
+	}
+	code := 1
+	if s.shutdown.Load() {
+		code = 0
+	}
+	log.FromContext(ctx).Info("Exit notification received", "code", code)
+	s.exitOnce.Do(func() {
+		s.exitCode = code
+		close(s.exited)
+	})
+	return nil
+}
+
+// SetShared makes the server a daemon for several editors, which outlives
+// the exit of any one of them
+func (s *Server) SetShared(shared bool) {
+	s.shared = shared
+}
+
+// Exited is closed once a client sent the exit notification
+func (s *Server) Exited() <-chan struct{} {
+	return s.exited
+}
+
+// ExitCode is the process exit code requested by the client, 0 if it never
+// sent exit
+func (s *Server) ExitCode() int {
+	select {
+	case <-s.exited:
+		return s.exitCode
+	default:
+		return 0
+	}
+}
+
+// startFlow counts a provider call in, unless the server is shutting down.
+// Once shutdown is set no call is counted in, so drain may wait for flows.
+func (s *Server) startFlow() bool {
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+	if s.shutdown.Load() {
+		return false
+	}
+	s.flows.Add(1)
+	return true
+}
+
+// drain waits up to timeout for in-flight provider calls and reports whether
+// they all finished
+func (s *Server) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.flows.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// cancelAll cancels the requests in flight of every client
+func (s *Server) cancelAll() {
+	s.mu.Lock()
+	conns := []*connection{s.out}
+	for _, c := range s.clients {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.cancelAll()
+	}
+}
+
+// errShuttingDown refuses work after the shutdown request
+var errShuttingDown = fmt.Errorf("server is shutting down")
@@ -0,0 +1,75 @@
+// Package logging configures the process-wide logger.
+//
+// Besides the levels of charmbracelet/log it accepts "trace", which is debug
+// plus prompt and completion bodies. Those may contain source code, so they
+// are never logged otherwise.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/charmbracelet/log"
+)
+
+const TraceLevel = "trace"
+
+var traceEnabled atomic.Bool
+
+// Options select how and where the logger writes
+type Options struct {
+	// Level is trace, debug, info, warn or error
+	Level string
+	// Format is text, json or logfmt
+	Format string
+	// File receives the log instead of stderr when set
+	File string
+}
+
+// Setup configures the default logger. The returned closer releases the log
+// file, if any.
+func Setup(opts Options) (io.Closer, error) {
+	level := strings.ToLower(opts.Level)
+	traceEnabled.Store(level == TraceLevel)
+	if level == TraceLevel {
+		level = log.DebugLevel.String()
+	}
+	if level != "" {
+		parsed, err := log.ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q", opts.Level)
+		}
+		log.SetLevel(parsed)
+	}
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		log.SetFormatter(log.TextFormatter)
+	case "json":
+		log.SetFormatter(log.JSONFormatter)
+	case "logfmt":
+		log.SetFormatter(log.LogfmtFormatter)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", opts.Format)
+	}
+	if opts.File == "" {
+		return io.NopCloser(nil), nil
+	}
+	f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log file: %v", err)
+	}
+	log.SetOutput(f)
+	return f, nil
+}
+
+// Trace logs potentially sensitive bodies, only when the level is trace
+func Trace(ctx context.Context, msg string, keyvals ...interface{}) {
+	if !traceEnabled.Load() {
+		return
+	}
+	log.FromContext(ctx).Debug(msg, append(keyvals, "trace", true)...)
+}
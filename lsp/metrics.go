@@ -0,0 +1,107 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/metrics"
+	"github.com/festeh/llm_flow/lsp/ratelimit"
+)
+
+type serverMetrics struct {
+	registry         *metrics.Registry
+	messages         *metrics.Counter
+	providerRequests *metrics.Counter
+	firstToken       *metrics.Histogram
+	latency          *metrics.Histogram
+	cancellations    *metrics.Counter
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		messages: r.Counter("llm_flow_messages_total",
+			"JSON-RPC messages received from clients.", "method"),
+		providerRequests: r.Counter("llm_flow_provider_requests_total",
+			"Requests sent to providers by outcome: ok, error, cancelled or the HTTP status.", "provider", "status"),
+		firstToken: r.Histogram("llm_flow_provider_first_token_seconds",
+			"Time until the first completion token arrived.", metrics.LatencyBuckets, "provider"),
+		latency: r.Histogram("llm_flow_provider_request_seconds",
+			"Time until the completion was complete.", metrics.LatencyBuckets, "provider"),
+		cancellations: r.Counter("llm_flow_cancellations_total",
+			"Completions abandoned while queued or in flight.", "provider", "stage"),
+	}
+	r.GaugeFunc("llm_flow_active_connections", "Connected clients.", nil,
+		func(set func(float64, ...string)) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			set(float64(len(s.clients)))
+		})
+	r.GaugeFunc("llm_flow_provider_queue_depth", "Requests waiting for a provider's rate limit.", []string{"provider"},
+		func(set func(float64, ...string)) {
+			s.limiters.Each(func(name string, l *ratelimit.Limiter) {
+				set(float64(l.QueueDepth()), name)
+			})
+		})
+	r.GaugeFunc("llm_flow_provider_in_flight", "Requests awaiting a provider's answer.", []string{"provider"},
+		func(set func(float64, ...string)) {
+			s.limiters.Each(func(name string, l *ratelimit.Limiter) {
+				set(float64(l.InFlight()), name)
+			})
+		})
+	return m
+}
+
+// observeFlow records the outcome of one provider request
+func (m *serverMetrics) observeFlow(ctx context.Context, provider string, trace *FlowTrace, elapsed time.Duration, err error) {
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		m.providerRequests.Inc(provider, "ok")
+		m.latency.Observe(elapsed.Seconds(), provider)
+	case errors.As(err, &statusErr):
+		m.providerRequests.Inc(provider, strconv.Itoa(statusErr.StatusCode))
+	case ctx.Err() != nil:
+		m.providerRequests.Inc(provider, "cancelled")
+		m.cancellations.Inc(provider, "in_flight")
+	default:
+		m.providerRequests.Inc(provider, "error")
+	}
+	if trace.FirstToken > 0 {
+		m.firstToken.Observe(trace.FirstToken.Seconds(), provider)
+	}
+}
+
+// ServeMetrics serves /metrics and /healthz on addr until ctx is done
+func (s *Server) ServeMetrics(ctx context.Context, addr string) error {
+	started := time.Now()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		connections := len(s.clients)
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "ok",
+			"uptime_seconds": int(time.Since(started).Seconds()),
+			"connections":    connections,
+		})
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Info("Serving metrics", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/provider/fake"
+)
+
+// newMockServer serves in-process predictions from a mock provider
+// answering with replies
+func newMockServer(t *testing.T, replies ...fake.Reply) (*Server, *provider.Mock) {
+	t.Helper()
+	mock := provider.NewMock(fake.Options{Replies: replies}, true)
+	t.Cleanup(mock.Close)
+	s := NewServer(io.Discard)
+	s.SetProvider(t.TempDir(), mock, "mock")
+	return s, mock
+}
+
+func openDocument(t *testing.T, s *Server, uri, text string) {
+	t.Helper()
+	err := s.TextDocumentDidOpen(context.Background(), &DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "go", Version: 1, Text: text},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPredictEditorMock(t *testing.T) {
+	s, mock := newMockServer(t, fake.Reply{Text: "return nil"})
+	uri := "file:///tmp/mock.go"
+	openDocument(t, s, uri, "package a\n\nfunc f() error {\n\t\n}\n")
+
+	got, err := s.PredictEditor(context.Background(), io.Discard, PredictEditorParams{URI: uri, Line: 3, Pos: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "return nil" {
+		t.Errorf("got %q, want %q", got, "return nil")
+	}
+	requests := mock.Backend().Requests()
+	if len(requests) != 1 {
+		t.Fatalf("backend got %d requests, want 1", len(requests))
+	}
+	if prefix, _ := requests[0]["prefix"].(string); prefix != "package a\n\nfunc f() error {\n\t" {
+		t.Errorf("sent prefix %q", prefix)
+	}
+	if suffix, _ := requests[0]["suffix"].(string); suffix != "\n}\n" {
+		t.Errorf("sent suffix %q", suffix)
+	}
+}
+
+func TestPredictEditorProviderError(t *testing.T) {
+	s, _ := newMockServer(t, fake.Reply{Status: http.StatusInternalServerError})
+	uri := "file:///tmp/mock.go"
+	openDocument(t, s, uri, "package a\n")
+
+	_, err := s.PredictEditor(context.Background(), io.Discard, PredictEditorParams{URI: uri, Line: 1})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got %v, want a 500 status error", err)
+	}
+}
+
+func TestRewriteMock(t *testing.T) {
+	c := newTestClient(t, NewServer(io.Discard))
+	c.initialize(mockOptions(url.Values{"text": {"Here it is:\n```go\n\tx := 1\n```\n"}}))
+	uri := "file:///tmp/rewrite.go"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": TextDocumentItem{URI: uri, LanguageID: "go", Version: 7, Text: "func f() {\n\tvar x = 1\n}\n"},
+	})
+	selection := Range{Start: Position{Line: 1}, End: Position{Line: 2}}
+	response := c.call("llm_flow/rewrite", RewriteParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Range:        selection,
+		Instruction:  "use a short variable declaration",
+	})
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	var edit WorkspaceEdit
+	if err := json.Unmarshal(response.Result, &edit); err != nil {
+		t.Fatal(err)
+	}
+	edits := edit.Changes[uri]
+	if len(edits) != 1 {
+		t.Fatalf("got edit %s", response.Result)
+	}
+	if edits[0].Range != selection || edits[0].NewText != "\tx := 1\n" {
+		t.Errorf("got %+v, want the selection replaced by the fenced code", edits[0])
+	}
+}
+
+func TestCodeActionsMock(t *testing.T) {
+	c := newTestClient(t, NewServer(io.Discard))
+	response := c.call("initialize", map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"codeAction": map[string]interface{}{
+					"resolveSupport": map[string]interface{}{"properties": []string{"edit"}},
+				},
+			},
+		},
+		"initializationOptions": mockOptions(url.Values{"text": {"```go\n// f does nothing\nfunc f() {}\n```"}}),
+	})
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	uri := "file:///tmp/actions.go"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": TextDocumentItem{URI: uri, LanguageID: "go", Version: 1, Text: "package a\n\nfunc f() {}\n"},
+	})
+	selection := Range{Start: Position{Line: 2}, End: Position{Line: 3}}
+	response = c.call("textDocument/codeAction", CodeActionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Range:        selection,
+		Context:      CodeActionContext{Only: []string{KindRewrite}},
+	})
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	var actions []CodeAction
+	if err := json.Unmarshal(response.Result, &actions); err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 3 {
+		t.Fatalf("got %d rewrite actions, want 3", len(actions))
+	}
+	for _, action := range actions {
+		if action.Kind != KindRewrite || action.Data == nil || action.Command != nil {
+			t.Errorf("got %+v, want a resolvable rewrite", action)
+		}
+	}
+
+	response = c.call("codeAction/resolve", actions[0])
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	var resolved CodeAction
+	if err := json.Unmarshal(response.Result, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Edit == nil || len(resolved.Edit.Changes[uri]) != 1 {
+		t.Fatalf("got %s, want an edit of the document", response.Result)
+	}
+	if got := resolved.Edit.Changes[uri][0].NewText; got != "// f does nothing\nfunc f() {}\n" {
+		t.Errorf("got %q", got)
+	}
+}
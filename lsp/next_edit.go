@@ -0,0 +1,179 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/document"
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// nextEditLines is how many lines on either side of the cursor the model
+// sees and may edit
+const nextEditLines = 30
+
+// nextEditMaxTokens bounds the answer, a single SEARCH/REPLACE block
+const nextEditMaxTokens = 512
+
+const cursorMarker = "<|cursor|>"
+
+const nextEditInstructions = `You predict the next edit a programmer will make to a file, following from the edits they just made: for example updating the remaining usages of something they renamed, or repeating a change on similar lines.
+
+Answer with exactly one block, without explanation:
+<<<<<<< SEARCH
+lines copied exactly from the code
+=======
+the same lines after the edit
+>>>>>>> REPLACE
+
+Answer NONE if no further edit follows from the recent ones.`
+
+var searchReplacePattern = regexp.MustCompile(`(?s)<{7}\s*SEARCH\r?\n(.*?)\r?\n?={7}\r?\n(.*?)\r?\n?>{7}\s*REPLACE`)
+
+// predictNextEdit asks a chat model for the edit that follows from the
+// history of doc, within nextEditLines of the cursor at offset
+func (s *Server) predictNextEdit(ctx context.Context, w io.Writer, doc *document.Snapshot, offset int, route Route) (*TextEdit, error) {
+	logger := log.FromContext(ctx)
+	history := doc.History()
+	if len(history) == 0 {
+		logger.Debug("No edits to follow")
+		return nil, nil
+	}
+	chat, err := provider.Chat(route.Provider, nextEditPrompt, false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot predict edits: %v", err)
+	}
+	route.Provider = chat
+	route.Sampling = provider.Sampling{
+		MaxTokens:   nextEditMaxTokens,
+		Temperature: route.Sampling.Temperature,
+		Seed:        route.Sampling.Seed,
+	}
+
+	line, _ := doc.Position(offset, UTF8)
+	regionStart, _ := doc.Offset(max(0, line-nextEditLines), 0, UTF8)
+	regionEnd, _ := doc.Offset(min(doc.LineCount()-1, line+nextEditLines), math.MaxInt, UTF8)
+	text := doc.Text()
+	pc := splitter.ProjectContext{
+		Repo:   route.Repo,
+		File:   uriToPath(doc.URI),
+		Prefix: text[regionStart:offset],
+		Suffix: text[offset:regionEnd],
+		Edits:  formatHistory(history),
+	}
+	answer, err := s.flow(ctx, route, pc, pc.File, w)
+	if err != nil {
+		return nil, err
+	}
+
+	match := searchReplacePattern.FindStringSubmatch(answer)
+	if match == nil || match[1] == "" || match[1] == match[2] {
+		logger.Debug("No edit predicted")
+		return nil, nil
+	}
+	search, replace := match[1], match[2]
+	start, ok := nearest(text[regionStart:regionEnd], search, offset-regionStart)
+	if !ok {
+		logger.Info("Predicted edit does not match the file")
+		return nil, nil
+	}
+	start += regionStart
+	end := start + len(search)
+
+	// Narrow the range to what changes, so that the client can jump to it
+	prefix, suffix := commonAffixes(search, replace)
+	encoding := s.positionEncoding(ctx)
+	startLine, startChar := doc.Position(start+prefix, encoding)
+	endLine, endChar := doc.Position(end-suffix, encoding)
+	return &TextEdit{
+		Range: Range{
+			Start: Position{Line: startLine, Character: startChar},
+			End:   Position{Line: endLine, Character: endChar},
+		},
+		NewText: replace[prefix : len(replace)-suffix],
+	}, nil
+}
+
+func nextEditPrompt(ctx splitter.ProjectContext) []provider.Message {
+	var b strings.Builder
+	fmt.Fprintf(&b, "File: %s\n\n", ctx.RelativeFile())
+	fmt.Fprintf(&b, "Recent edits, oldest first:\n%s\n", ctx.Edits)
+	fmt.Fprintf(&b, "Code around the cursor, marked with %s:\n%s%s%s", cursorMarker, ctx.Prefix, cursorMarker, ctx.Suffix)
+	return []provider.Message{
+		{Role: "system", Content: nextEditInstructions},
+		{Role: "user", Content: b.String()},
+	}
+}
+
+// formatHistory renders changes as unified diff hunks
+func formatHistory(changes []document.Change) string {
+	var b strings.Builder
+	for _, change := range changes {
+		fmt.Fprintf(&b, "@@ line %d @@\n", change.Line+1)
+		writeLines(&b, "-", change.Before)
+		writeLines(&b, "+", change.After)
+	}
+	return b.String()
+}
+
+func writeLines(b *strings.Builder, marker string, text string) {
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(b, "%s%s\n", marker, line)
+	}
+}
+
+// nearest returns the offset of the occurrence of search in text closest to
+// cursor
+func nearest(text, search string, cursor int) (int, bool) {
+	best, found := 0, false
+	for from := 0; ; {
+		i := strings.Index(text[from:], search)
+		if i < 0 {
+			return best, found
+		}
+		i += from
+		if !found || distance(i, len(search), cursor) < distance(best, len(search), cursor) {
+			best, found = i, true
+		}
+		from = i + 1
+	}
+}
+
+// distance from cursor to the span of n bytes at start
+func distance(start, n, cursor int) int {
+	switch {
+	case cursor < start:
+		return start - cursor
+	case cursor > start+n:
+		return cursor - start - n
+	}
+	return 0
+}
+
+// commonAffixes returns the lengths of the longest common prefix and suffix
+// of a and b, not overlapping and not splitting runes
+func commonAffixes(a, b string) (prefix, suffix int) {
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(a) && !utf8.RuneStart(a[prefix]) {
+		prefix--
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(a[len(a)-suffix]) {
+		suffix--
+	}
+	return prefix, suffix
+}
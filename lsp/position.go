@@ -0,0 +1,56 @@
+package lsp
+
+import (
+	"context"
+
+	"github.com/festeh/llm_flow/lsp/document"
+)
+
+// Position encodings, the unit Position.Character counts in
+const (
+	UTF8  = document.UTF8
+	UTF16 = document.UTF16
+	UTF32 = document.UTF32
+)
+
+// negotiateEncoding picks the first of the client's encodings the server
+// supports, in the client's order of preference. Every client speaks UTF-16.
+func negotiateEncoding(offered []string) string {
+	for _, encoding := range offered {
+		switch encoding {
+		case UTF8, UTF16, UTF32:
+			return encoding
+		}
+	}
+	return UTF16
+}
+
+// positionEncoding is the encoding agreed on with the client of ctx
+func (s *Server) positionEncoding(ctx context.Context) string {
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.encoding != "" {
+		return c.encoding
+	}
+	return UTF16
+}
+
+// capabilities returns the capabilities of the client of ctx, as each editor
+// sharing a daemon has its own
+func (s *Server) capabilities(ctx context.Context) ClientCapabilities {
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilities
+}
+
+// offsetRange converts the bytes from start to end of doc to a Range
+func offsetRange(doc *document.Snapshot, start, end int, encoding string) Range {
+	startLine, startChar := doc.Position(start, encoding)
+	endLine, endChar := doc.Position(end, encoding)
+	return Range{
+		Start: Position{Line: startLine, Character: startChar},
+		End:   Position{Line: endLine, Character: endChar},
+	}
+}
@@ -16,8 +16,8 @@ func (s *Server) HandlePredictRequest(ctx context.Context, params json.RawMessag
 		Text             string `json:"text"`
 		ProviderAndModel string `json:"providerAndModel"`
 	}
-	if err := json.Unmarshal(params, &predictParams); err != nil {
-		return fmt.Errorf("invalid predict params: %v", err)
+	if err := decodeParams(params, &predictParams); err != nil {
+		return err
 	}
 	if predictParams.ProviderAndModel == "" {
 		predictParams.ProviderAndModel = "codestral/codestral-latest"
@@ -27,14 +27,14 @@ func (s *Server) HandlePredictRequest(ctx context.Context, params json.RawMessag
 	go func() {
 		defer pw.Close()
 		if err := s.Predict(ctx, pw, predictParams.Text, predictParams.ProviderAndModel); err != nil {
-			log.Printf("Prediction error: %v", err)
+			log.FromContext(ctx).Error("Prediction", "error", err)
 		}
 		// Send completion notification after prediction is done
 		response := map[string]interface{}{
 			"jsonrpc": "2.0",
 			"method":  "predict/complete",
 		}
-		s.sendResponse(response)
+		s.sendResponse(ctx, response)
 	}()
 
 	scanner := bufio.NewScanner(pr)
@@ -46,7 +46,7 @@ func (s *Server) HandlePredictRequest(ctx context.Context, params json.RawMessag
 				Content: scanner.Text(),
 			},
 		}
-		s.sendResponse(response)
+		s.sendResponse(ctx, response)
 	}
 	return nil
 }
@@ -56,11 +56,15 @@ func (s *Server) Predict(ctx context.Context, w io.Writer, text string, provider
 	if len(parts) != 2 {
 		return fmt.Errorf("invalid provider/model format: must be in format provider/model")
 	}
-	provider := s.config.Provider
-	if provider == nil {
+	cfg := s.connFrom(ctx).config
+	if !cfg.configured() {
 		return fmt.Errorf("provider not set")
 	}
+	route, err := cfg.withinBudget(ctx, s.usage, cfg.DefaultRoute())
+	if err != nil {
+		return err
+	}
 	ps := splitter.ProjectContext{Prefix: text}
-	_, err := Flow(*provider, ps, ctx, w)
+	_, err = s.flow(ctx, route, ps, "", w)
 	return err
 }
@@ -2,122 +2,192 @@ package lsp
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/block"
+	"github.com/festeh/llm_flow/lsp/document"
+	"github.com/festeh/llm_flow/lsp/provider"
 	"github.com/festeh/llm_flow/lsp/splitter"
 )
 
-func (s *Server) HandlePredictEditor(header Header, ctx context.Context) error {
+// HandlePredictEditor answers a predict_editor request once the prediction
+// is done; the dispatcher runs it alongside other requests
+func (s *Server) HandlePredictEditor(header Header, ctx context.Context) (*PredictResponse, error) {
+	if header.ID == nil {
+		return nil, newError(InvalidRequest, "predict_editor must be a request")
+	}
+	id := *header.ID
 	var params PredictEditorParams
-	if err := json.Unmarshal(header.Params, &params); err != nil {
-		return fmt.Errorf("invalid predict params: %v", err)
-	}
-	log.Info("got predict_request", "id", header.ID, "line", params.Line, "pos", params.Pos)
-	// Create cancellable context
-	predCtx, cancel := context.WithCancel(ctx)
-	s.predictionsMu.Lock()
-	s.activePredictions[header.ID] = cancel
-	s.predictionsMu.Unlock()
+	if err := decodeParams(header.Params, &params); err != nil {
+		return nil, err
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	logger := log.FromContext(ctx).With("uri", params.URI)
+	ctx = log.WithContext(ctx, logger)
+	logger.Info("got predict_request", "line", params.Line, "pos", params.Pos, "mode", params.Mode)
 
-	_, pw := io.Pipe()
-	go func() {
-		defer pw.Close()
-		content, err := s.PredictEditor(predCtx, pw, params)
-		// Clean up prediction tracking
-		if err != nil {
-			log.Error("Prediction", "error", err, "id", header.ID)
-			s.predictionsMu.Lock()
-			s.sendCancel(header.ID)
-			s.predictionsMu.Unlock()
-			return
-		}
-		log.Info("Done", "id", header.ID)
-		// Send completion notification after prediction is done
-		response := map[string]interface{}{
-			"jsonrpc": "2.0",
-			"id":      header.ID,
-			"result": PredictResponse{
-				ID:      header.ID,
-				Content: content,
-			},
+	start := time.Now()
+	// The snapshot stays as it is while edits come in
+	doc, exists := s.snapshot(ctx, params.URI)
+	if !exists {
+		return nil, fmt.Errorf("document not found: %s", params.URI)
+	}
+	route, err := s.routeFor(ctx, params.URI)
+	var edit *TextEdit
+	if err == nil {
+		edit, err = s.predictEditor(ctx, io.Discard, doc, params, route)
+	}
+	if err != nil {
+		if toResponseError(ctx, err).Code == RequestCancelled {
+			logger.Info("Prediction cancelled", "elapsed", time.Since(start))
+		} else {
+			logger.Error("Prediction", "error", err, "elapsed", time.Since(start))
 		}
-		s.predictionsMu.Lock()
-		delete(s.activePredictions, header.ID)
-		s.sendResponse(response)
-		s.predictionsMu.Unlock()
-	}()
-
-	// scanner := bufio.NewScanner(pr)
-	// for scanner.Scan() {
-	// _ := map[string]interface{}{
-	// 	"jsonrpc": "2.0",
-	// 	"method":  "predict/response",
-	// 	"params": PredictResponse{
-	// 		Content: scanner.Text(),
-	// 	},
-	// }
-	// s.sendResponse(response)
-	// }
-	return nil
+		return nil, err
+	}
+	logger.Info("Done", "route", route.Name, "provider", route.Provider.Name(), "elapsed", time.Since(start))
+	var content string
+	if edit != nil {
+		content = edit.NewText
+	}
+	s.recordPrediction(ctx, id, params.URI, route, content, time.Since(start))
+	return &PredictResponse{
+		ID:      header.ID,
+		Content: content,
+		Route:   route.Name,
+		Version: doc.Version,
+		Edit:    edit,
+	}, nil
 }
 
 func (s *Server) PredictEditor(ctx context.Context, w io.Writer, params PredictEditorParams) (string, error) {
-	if s.config.Provider == nil {
-		return "", fmt.Errorf("Provider not set")
+	if err := params.validate(); err != nil {
+		return "", err
 	}
-	// Get document content
-	doc, exists := s.documents[params.URI]
+	doc, exists := s.snapshot(ctx, params.URI)
 	if !exists {
 		return "", fmt.Errorf("document not found: %s", params.URI)
 	}
+	route, err := s.routeFor(ctx, params.URI)
+	if err != nil {
+		return "", err
+	}
+	edit, err := s.predictEditor(ctx, w, doc, params, route)
+	if err != nil || edit == nil {
+		return "", err
+	}
+	return edit.NewText, nil
+}
 
-	// Split document into lines
-	lines := strings.Split(doc, "\n")
-	if params.Line >= len(lines) {
-		return "", fmt.Errorf("line number out of range: %d", params.Line)
+// predictEditor returns the edit predicted at the cursor, nil if there is
+// none
+func (s *Server) predictEditor(ctx context.Context, w io.Writer, doc *document.Snapshot, params PredictEditorParams, route Route) (*TextEdit, error) {
+	if route.Provider == nil {
+		return nil, fmt.Errorf("Provider not set")
 	}
+	filePath := uriToPath(params.URI)
+	if route.Redactor.Denied(route.Repo, filePath) {
+		log.FromContext(ctx).Info("Completions disabled for file")
+		return nil, nil
+	}
+	encoding := s.positionEncoding(ctx)
+	offset, err := doc.Offset(params.Line, params.Pos, encoding)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.FromContext(ctx).With("route", route.Name)
+	logger.Info("Routing", "provider", route.Provider.Name(), "model", route.Model)
+	ctx = log.WithContext(ctx, logger)
+	if params.Mode == ModeNextEdit {
+		return s.predictNextEdit(ctx, w, doc, offset, route)
+	}
+	text := doc.Text()
+	prefix, suffix := text[:offset], text[offset:]
+	prefixSuffix := splitter.ProjectContext{Repo: route.Repo, Prefix: prefix, Suffix: suffix, File: filePath}
+	prefixSuffix = prefixSuffix.Trim(route.ContextBudget)
+	if params.Mode == ModeBlock {
+		route.Sampling = blockSampling(route)
+	}
+	content, err := s.flow(ctx, route, prefixSuffix, filePath, w)
+	if err != nil {
+		return nil, err
+	}
+	if params.Mode == ModeBlock {
+		before, after := cursorLine(text, offset)
+		content = block.Trim(content, before, after)
+	}
+	edit := completionEdit(doc, offset, content, encoding)
+	return &edit, nil
+}
+
+// Completion modes of predict_editor
+const (
+	// ModeLine completes the cursor's line, within the provider's usual
+	// token budget
+	ModeLine = "line"
+	// ModeBlock asks for the rest of the statement, block or function body
+	// the cursor is in
+	ModeBlock = "block"
+	// ModeNextEdit predicts the edit that follows from the recent ones,
+	// which may be away from the cursor
+	ModeNextEdit = "next_edit"
+)
+
+// blockMaxTokens is the token budget of block completions, unless the route
+// asks for more
+const blockMaxTokens = 256
 
-	currentLine := lines[params.Line]
-	prefix := strings.Join(lines[:params.Line], "\n")
-	if params.Line > 0 {
-		prefix += "\n"
+func (p PredictEditorParams) validate() error {
+	switch p.Mode {
+	case "", ModeLine, ModeBlock, ModeNextEdit:
+		return nil
 	}
+	return newError(InvalidParams, "unknown mode %q, expected %q, %q or %q", p.Mode, ModeLine, ModeBlock, ModeNextEdit)
+}
 
-	pos := params.Pos
-	suffix := ""
-	if pos >= len(currentLine) {
-		prefix += currentLine
-	} else {
-		prefix += currentLine[:pos]
-		suffix = currentLine[pos:]
+func blockSampling(route Route) provider.Sampling {
+	sampling := route.Sampling
+	sampling.MaxTokens = max(sampling.MaxTokens, blockMaxTokens)
+	if limit := route.Provider.Capabilities().MaxTokens; limit > 0 {
+		sampling.MaxTokens = min(sampling.MaxTokens, limit)
 	}
+	return sampling
+}
 
-	if params.Line < len(lines)-1 {
-		suffix += "\n" + strings.Join(lines[params.Line+1:], "\n")
+// cursorLine returns the text of the line at offset on either side of it
+func cursorLine(text string, offset int) (before, after string) {
+	start := strings.LastIndexByte(text[:offset], '\n') + 1
+	end := len(text)
+	if i := strings.IndexByte(text[offset:], '\n'); i >= 0 {
+		end = offset + i
 	}
-	filePath := strings.TrimPrefix(params.URI, "file://")
-  prefixSuffix := splitter.ProjectContext{Repo: s.config.Repo, Prefix: prefix, Suffix: suffix, File: filePath}
-	return Flow(*s.config.Provider, prefixSuffix, ctx, w)
+	return text[start:offset], strings.TrimSuffix(text[offset:end], "\r")
 }
 
-func (s *Server) HandleCancelPredictEditor(header Header) {
-	s.predictionsMu.Lock()
-	params := CancelParams{}
-	err := json.Unmarshal(header.Params, &params)
-	if err != nil {
-		log.Info("Err in cancel", err)
+// completionEdit inserts content at offset. When the first line of content
+// ends with the rest of the cursor's line, as when it closes a bracket that
+// follows the cursor, that rest is replaced rather than pushed after the
+// completion.
+func completionEdit(doc *document.Snapshot, offset int, content string, encoding string) TextEdit {
+	end := offset
+	_, after := cursorLine(doc.Text(), offset)
+	firstLine, _, _ := strings.Cut(content, "\n")
+	if rest := strings.TrimSpace(after); rest != "" && strings.HasSuffix(strings.TrimSpace(firstLine), rest) {
+		end += len(after)
 	}
-	id := params.ID
-	log.Info("Cancel", "id", id)
-	cancel, ok := s.activePredictions[id]
-	if ok {
-		cancel()
-		delete(s.activePredictions, id)
-		log.Info("Cancelled prediction %v", id)
+	startLine, startChar := doc.Position(offset, encoding)
+	endLine, endChar := doc.Position(end, encoding)
+	return TextEdit{
+		Range: Range{
+			Start: Position{Line: startLine, Character: startChar},
+			End:   Position{Line: endLine, Character: endChar},
+		},
+		NewText: content,
 	}
-	s.predictionsMu.Unlock()
 }
@@ -0,0 +1,57 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// progress reports the answer of a provider as it streams in, with
+// $/progress notifications naming the line being written. Without a token it
+// only discards what is written to it.
+type progress struct {
+	s     *Server
+	ctx   context.Context
+	token *ID
+	lines int
+}
+
+// beginProgress starts reporting on token, the client's workDoneToken. When
+// the client gave none but lets the server create one, a token is created.
+func (s *Server) beginProgress(ctx context.Context, token *ID, title string) *progress {
+	if token == nil && s.capabilities(ctx).Window.WorkDoneProgress {
+		created := ID{IsString: true, Str: fmt.Sprintf("llm_flow/%d", s.nextProgress.Add(1))}
+		if _, err := s.call(ctx, "window/workDoneProgress/create", map[string]interface{}{"token": created}); err != nil {
+			log.FromContext(ctx).Debug("No progress token", "error", err)
+		} else {
+			token = &created
+		}
+	}
+	p := &progress{s: s, ctx: ctx, token: token}
+	p.send(WorkDoneProgress{Kind: "begin", Title: title})
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	lines := p.lines + strings.Count(string(b), "\n")
+	if lines != p.lines {
+		p.lines = lines
+		p.send(WorkDoneProgress{Kind: "report", Message: fmt.Sprintf("Writing line %d", lines+1)})
+	}
+	return len(b), nil
+}
+
+func (p *progress) end(message string) {
+	p.send(WorkDoneProgress{Kind: "end", Message: message})
+}
+
+func (p *progress) send(value WorkDoneProgress) {
+	if p.token == nil {
+		return
+	}
+	if err := p.s.notify(p.ctx, "$/progress", ProgressParams{Token: *p.token, Value: value}); err != nil {
+		log.FromContext(p.ctx).Debug("Progress", "error", err)
+	}
+}
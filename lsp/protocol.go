@@ -1,5 +1,7 @@
 package lsp
 
+import "encoding/json"
+
 // Position in a text document expressed as zero-based line and character offset
 type Position struct {
 	Line      int `json:"line"`
@@ -12,6 +14,12 @@ type Range struct {
 	End   Position `json:"end"`
 }
 
+// TextEdit replaces the text of a range
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
 // TextDocumentItem represents an open text document
 type TextDocumentItem struct {
 	URI        string `json:"uri"`
@@ -22,8 +30,76 @@ type TextDocumentItem struct {
 
 // InitializeParams represents parameters for initialize request
 type InitializeParams struct {
-	ProcessID int    `json:"processId"`
-	RootURI   string `json:"rootUri"`
+	ProcessID             int                `json:"processId"`
+	RootURI               string             `json:"rootUri"`
+	InitializationOptions json.RawMessage    `json:"initializationOptions,omitempty"`
+	Capabilities          ClientCapabilities `json:"capabilities"`
+	WorkspaceFolders      []WorkspaceFolder  `json:"workspaceFolders,omitempty"`
+}
+
+// ClientCapabilities holds the client capabilities the server cares about
+type ClientCapabilities struct {
+	General      GeneralClientCapabilities      `json:"general"`
+	Workspace    WorkspaceClientCapabilities    `json:"workspace"`
+	Window       WindowClientCapabilities       `json:"window"`
+	TextDocument TextDocumentClientCapabilities `json:"textDocument"`
+}
+
+type GeneralClientCapabilities struct {
+	// PositionEncodings lists the encodings the client supports, preferred
+	// first
+	PositionEncodings []string `json:"positionEncodings"`
+}
+
+type WorkspaceClientCapabilities struct {
+	Configuration bool `json:"configuration"`
+	// ApplyEdit is set when the client accepts workspace/applyEdit
+	ApplyEdit     bool `json:"applyEdit"`
+	WorkspaceEdit struct {
+		// DocumentChanges is set when edits may name the document version
+		// they apply to
+		DocumentChanges bool `json:"documentChanges"`
+		// ResourceOperations lists the file operations edits may contain,
+		// such as "create"
+		ResourceOperations []string `json:"resourceOperations"`
+	} `json:"workspaceEdit"`
+}
+
+type TextDocumentClientCapabilities struct {
+	CodeAction struct {
+		ResolveSupport struct {
+			// Properties lists the code action properties the client
+			// resolves lazily with codeAction/resolve
+			Properties []string `json:"properties"`
+		} `json:"resolveSupport"`
+	} `json:"codeAction"`
+}
+
+type WindowClientCapabilities struct {
+	// WorkDoneProgress is set when the server may create progress tokens
+	WorkDoneProgress bool `json:"workDoneProgress"`
+}
+
+// WorkspaceFolder is a root folder opened in the client
+type WorkspaceFolder struct {
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+// DidChangeConfigurationParams params for workspace/didChangeConfiguration
+type DidChangeConfigurationParams struct {
+	Settings json.RawMessage `json:"settings"`
+}
+
+// ConfigurationItem asks the client for one settings section
+type ConfigurationItem struct {
+	ScopeURI string `json:"scopeUri,omitempty"`
+	Section  string `json:"section,omitempty"`
+}
+
+// ConfigurationParams params for the workspace/configuration request
+type ConfigurationParams struct {
+	Items []ConfigurationItem `json:"items"`
 }
 
 type ServerInfo struct {
@@ -49,10 +125,24 @@ type SaveOptions struct {
 	IncludeText bool `json:"includeText"`
 }
 
+// ExecuteCommandOptions lists the commands of workspace/executeCommand
+type ExecuteCommandOptions struct {
+	Commands []string `json:"commands"`
+}
+
+// CodeActionOptions lists the kinds of code actions the server offers
+type CodeActionOptions struct {
+	CodeActionKinds []string `json:"codeActionKinds"`
+	ResolveProvider bool     `json:"resolveProvider"`
+}
+
 // ServerCapabilities represents server capabilities
 type ServerCapabilities struct {
-	TextDocumentSync   TextDocumentSyncOptions `json:"textDocumentSync"`
-	CompletionProvider bool                    `json:"completionProvider"`
+	PositionEncoding       string                  `json:"positionEncoding"`
+	TextDocumentSync       TextDocumentSyncOptions `json:"textDocumentSync"`
+	CompletionProvider     bool                    `json:"completionProvider"`
+	ExecuteCommandProvider ExecuteCommandOptions   `json:"executeCommandProvider"`
+	CodeActionProvider     CodeActionOptions       `json:"codeActionProvider"`
 }
 
 // DidOpenTextDocumentParams params for textDocument/didOpen
@@ -62,7 +152,8 @@ type DidOpenTextDocumentParams struct {
 
 // TextDocumentContentChangeEvent represents a change to a text document
 type TextDocumentContentChangeEvent struct {
-	Range Range  `json:"range"`
+	// Range is nil when Text is the whole document
+	Range *Range `json:"range,omitempty"`
 	Text  string `json:"text"`
 }
 
@@ -72,6 +163,107 @@ type DidChangeTextDocumentParams struct {
 	ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
 }
 
+// TextDocumentIdentifier names a text document
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+// OptionalVersionedTextDocumentIdentifier names a version of a text
+// document; Version is nil for files that are not open
+type OptionalVersionedTextDocumentIdentifier struct {
+	URI     string `json:"uri"`
+	Version *int   `json:"version"`
+}
+
+// TextDocumentEdit holds the edits to one version of a document
+type TextDocumentEdit struct {
+	TextDocument OptionalVersionedTextDocumentIdentifier `json:"textDocument"`
+	Edits        []TextEdit                              `json:"edits"`
+}
+
+// CreateFile is the resource operation creating a file
+type CreateFile struct {
+	// Kind is always "create"
+	Kind string `json:"kind"`
+	URI  string `json:"uri"`
+}
+
+// WorkspaceEdit holds edits to documents, either by URI in Changes or, for
+// clients that support it, in DocumentChanges, as TextDocumentEdit and
+// CreateFile operations applied in order
+type WorkspaceEdit struct {
+	Changes         map[string][]TextEdit `json:"changes,omitempty"`
+	DocumentChanges []interface{}         `json:"documentChanges,omitempty"`
+}
+
+// ApplyWorkspaceEditParams params for the workspace/applyEdit request
+type ApplyWorkspaceEditParams struct {
+	Label string        `json:"label,omitempty"`
+	Edit  WorkspaceEdit `json:"edit"`
+}
+
+// ApplyWorkspaceEditResult is the client's answer to workspace/applyEdit
+type ApplyWorkspaceEditResult struct {
+	Applied       bool   `json:"applied"`
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+// ExecuteCommandParams params for workspace/executeCommand
+type ExecuteCommandParams struct {
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments,omitempty"`
+}
+
+// CodeActionContext narrows the code actions asked for
+type CodeActionContext struct {
+	// Only lists the kinds of actions wanted, all if empty
+	Only []string `json:"only,omitempty"`
+}
+
+// CodeActionParams params for textDocument/codeAction
+type CodeActionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Range        Range                  `json:"range"`
+	Context      CodeActionContext      `json:"context"`
+}
+
+// Command is a workspace/executeCommand the client runs for the user
+type Command struct {
+	Title     string        `json:"title"`
+	Command   string        `json:"command"`
+	Arguments []interface{} `json:"arguments,omitempty"`
+}
+
+// CodeAction is an action offered on a range. Edit is filled in by
+// codeAction/resolve from Data.
+type CodeAction struct {
+	Title   string          `json:"title"`
+	Kind    string          `json:"kind"`
+	Edit    *WorkspaceEdit  `json:"edit,omitempty"`
+	Command *Command        `json:"command,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// ProgressParams params for the $/progress notification
+type ProgressParams struct {
+	Token ID          `json:"token"`
+	Value interface{} `json:"value"`
+}
+
+// WorkDoneProgress is the value of a $/progress notification; Kind is
+// "begin", "report" or "end"
+type WorkDoneProgress struct {
+	Kind        string `json:"kind"`
+	Title       string `json:"title,omitempty"`
+	Cancellable bool   `json:"cancellable,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// DidCloseTextDocumentParams params for textDocument/didClose
+type DidCloseTextDocumentParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
 // CompletionItem represents a completion item
 type CompletionItem struct {
 	Label  string `json:"label"`
@@ -94,4 +286,10 @@ type PredictParams struct {
 type PredictResponse struct {
 	ID      interface{} `json:"id"`
 	Content string      `json:"content"`
+	// Route names the routing rule or profile that produced the prediction
+	Route string `json:"route,omitempty"`
+	// Version of the document the prediction was made for
+	Version int `json:"version"`
+	// Edit applies Content to that version of the document
+	Edit *TextEdit `json:"edit,omitempty"`
 }
@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// Message is one turn of a chat conversation
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Chatter providers also serve a chat completions API, used for requests
+// that take instructions rather than filling in the middle
+type Chatter interface {
+	ChatEndpoint() string
+	GetChatRequestBody([]Message, Sampling) (map[string]interface{}, error)
+}
+
+// Prompt builds the conversation for a (redacted) project context
+type Prompt func(splitter.ProjectContext) []Message
+
+// Chat returns p sending the conversation prompt builds to its chat endpoint
+// instead of a completion request, so that it goes through the same flow.
+// With stream, the answer is streamed as it is generated.
+func Chat(p Provider, prompt Prompt, stream bool) (Provider, error) {
+	chatter, ok := p.(Chatter)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support chat", p.Name())
+	}
+	return &chat{Provider: p, chatter: chatter, prompt: prompt, stream: stream}, nil
+}
+
+type chat struct {
+	Provider
+	chatter Chatter
+	prompt  Prompt
+	stream  bool
+}
+
+func (c *chat) GetRequestBody(ctx splitter.ProjectContext, sampling Sampling) (map[string]interface{}, error) {
+	data, err := c.chatter.GetChatRequestBody(c.prompt(ctx), sampling)
+	if err != nil {
+		return nil, err
+	}
+	data["stream"] = c.stream
+	return data, nil
+}
+
+func (c *chat) Endpoint() string {
+	return c.chatter.ChatEndpoint()
+}
+
+func (c *chat) IsStreaming() bool {
+	return c.stream
+}
+
+func (c *chat) NewResponse() Response {
+	return &ChatResponse{}
+}
+
+// chatRequestBody is the OpenAI style chat request the supported providers
+// accept
+func chatRequestBody(model string, messages []Message, sampling Sampling, seedKey string) map[string]interface{} {
+	data := map[string]interface{}{
+		"model":       model,
+		"messages":    messages,
+		"temperature": 0,
+		"stream":      false,
+	}
+	sampling.apply(data, "max_tokens", seedKey)
+	return data
+}
+
+// ChatResponse is the non-streaming chat completions response
+type ChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+func (r *ChatResponse) Validate() error {
+	if len(r.Choices) == 0 {
+		return fmt.Errorf("no choices in response")
+	}
+	return nil
+}
+
+func (r *ChatResponse) GetResult() string {
+	return r.Choices[0].Message.Content
+}
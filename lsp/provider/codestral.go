@@ -2,13 +2,12 @@ package provider
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/festeh/llm_flow/lsp/splitter"
 )
 
 type Codestral struct {
-	key   string
+	key   KeySource
 	model string
 }
 
@@ -16,16 +15,15 @@ func (c *Codestral) Name() string {
 	return "codestral"
 }
 
-func newCodestral() (*Codestral, error) {
-	// get CODESTRAL_API_KEY from env
-	key := os.Getenv("CODESTRAL_API_KEY")
-	if key == "" {
-		return nil, fmt.Errorf("CODESTRAL_API_KEY not found")
+func newCodestral(keySpec string) (*Codestral, error) {
+	key, err := newKeySource(keySpec, KeyEnvs["codestral"])
+	if err != nil {
+		return nil, err
 	}
 	return &Codestral{key: key, model: "codestral-latest"}, nil
 }
 
-func (c *Codestral) GetRequestBody(prefixSuffix splitter.ProjectContext) (map[string]interface{}, error) {
+func (c *Codestral) GetRequestBody(prefixSuffix splitter.ProjectContext, sampling Sampling) (map[string]interface{}, error) {
 	data := map[string]interface{}{
 		"model":       c.model,
 		"max_tokens":  64,
@@ -34,11 +32,24 @@ func (c *Codestral) GetRequestBody(prefixSuffix splitter.ProjectContext) (map[st
 		"prefix":      prefixSuffix.Prefix,
 		"suffix":      prefixSuffix.Suffix,
 	}
+	sampling.apply(data, "max_tokens", "random_seed")
 	return data, nil
 }
 
-func (c *Codestral) GetAuthHeader() string {
-	return "Bearer " + c.key
+func (c *Codestral) GetChatRequestBody(messages []Message, sampling Sampling) (map[string]interface{}, error) {
+	return chatRequestBody(c.model, messages, sampling, "random_seed"), nil
+}
+
+func (c *Codestral) ChatEndpoint() string {
+	return "https://codestral.mistral.ai/v1/chat/completions"
+}
+
+func (c *Codestral) Capabilities() Capabilities {
+	return Capabilities{MaxTemperature: 1.5, TopP: true, Seed: true, MaxStop: 16}
+}
+
+func (c *Codestral) GetAuthHeader() (string, error) {
+	return bearer(c.key)
 }
 
 func (c *Codestral) Endpoint() string {
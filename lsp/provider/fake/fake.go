@@ -0,0 +1,204 @@
+// Package fake provides an in-process HTTP backend that speaks the wire
+// formats of the completion APIs llm_flow talks to.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	// Codestral FIM: streams choices[].delta.content, returns choices[].message.content
+	Codestral Format = iota
+	// Nebius (OpenAI completions): choices[].text in both modes
+	Nebius
+	// OpenAI chat completions: streams choices[].delta.content, returns choices[].message.content
+	OpenAI
+	// Huggingface inference API: [{"generated_text": ...}]
+	Huggingface
+)
+
+// Reply scripts one response of the backend
+type Reply struct {
+	Text string
+	// Delay before the first byte is sent
+	Delay time.Duration
+	// Status other than 0 or 200 makes the backend fail with that code
+	Status int
+}
+
+type Options struct {
+	Format Format
+	// Replies are served in order, the last one repeats
+	Replies []Reply
+	// Complete, when set, computes the completion text from the request body
+	// and takes precedence over Reply.Text
+	Complete func(body map[string]interface{}) string
+	// ChunkSize is the number of runes per streamed chunk (default 4)
+	ChunkSize int
+	// ChunkDelay is the pause between streamed chunks
+	ChunkDelay time.Duration
+}
+
+// Server is a fake completion backend listening on the loopback interface
+type Server struct {
+	// URL is the base URL of the backend, e.g. http://127.0.0.1:41234
+	URL      string
+	server   *http.Server
+	opts     Options
+	mu       sync.Mutex
+	requests []map[string]interface{}
+}
+
+func NewServer(opts Options) *Server {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 4
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("fake: failed to listen: %v", err))
+	}
+	s := &Server{URL: "http://" + listener.Addr().String(), opts: opts}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(listener)
+	return s
+}
+
+// Close stops the backend, dropping requests in flight
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Requests returns the decoded bodies of all requests received so far
+func (s *Server) Requests() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}(nil), s.requests...)
+}
+
+func (s *Server) nextReply() Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.requests) - 1
+	if len(s.opts.Replies) == 0 {
+		return Reply{}
+	}
+	if n >= len(s.opts.Replies) {
+		n = len(s.opts.Replies) - 1
+	}
+	return s.opts.Replies[n]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, body)
+	s.mu.Unlock()
+
+	reply := s.nextReply()
+	if s.opts.Complete != nil {
+		reply.Text = s.opts.Complete(body)
+	}
+	if !sleep(r, reply.Delay) {
+		return
+	}
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(reply.Status)
+		fmt.Fprintf(w, `{"object":"error","message":%q}`, http.StatusText(reply.Status))
+		return
+	}
+
+	stream, _ := body["stream"].(bool)
+	if stream && s.opts.Format != Huggingface {
+		s.stream(w, r, reply.Text)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.complete(reply.Text, body))
+}
+
+// sleep waits for d unless the client goes away first
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, text string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	runes := []rune(text)
+	for i := 0; i < len(runes); i += s.opts.ChunkSize {
+		chunk := string(runes[i:min(i+s.opts.ChunkSize, len(runes))])
+		data, _ := json.Marshal(s.chunk(chunk))
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !sleep(r, s.opts.ChunkDelay) {
+			return
+		}
+	}
+	io.WriteString(w, "data: [DONE]\n\n")
+}
+
+func (s *Server) chunk(text string) map[string]interface{} {
+	choice := map[string]interface{}{"index": 0}
+	if s.opts.Format == Nebius {
+		choice["text"] = text
+	} else {
+		choice["delta"] = map[string]string{"content": text}
+	}
+	return map[string]interface{}{"choices": []interface{}{choice}}
+}
+
+func (s *Server) complete(text string, body map[string]interface{}) interface{} {
+	if s.opts.Format == Huggingface {
+		return []map[string]string{{"generated_text": text}}
+	}
+	choice := map[string]interface{}{"index": 0, "finish_reason": "stop"}
+	if s.opts.Format == Nebius {
+		choice["text"] = text
+	} else {
+		choice["message"] = map[string]string{"role": "assistant", "content": text}
+	}
+	prompt := 0
+	for _, key := range []string{"prompt", "prefix", "suffix"} {
+		if v, ok := body[key].(string); ok {
+			prompt += len(strings.Fields(v))
+		}
+	}
+	completion := len(strings.Fields(text))
+	return map[string]interface{}{
+		"choices": []interface{}{choice},
+		"usage": map[string]int{
+			"prompt_tokens":     prompt,
+			"completion_tokens": completion,
+			"total_tokens":      prompt + completion,
+		},
+	}
+}
@@ -2,15 +2,16 @@ package provider
 
 import (
 	"fmt"
-	"os"
+	"text/template"
 
 	"github.com/festeh/llm_flow/lsp/splitter"
 )
 
 type Huggingface struct {
-	key       string
+	key       KeySource
 	model     string
 	streaming bool
+	template  *template.Template
 }
 
 type HuggingfaceResponse []struct {
@@ -39,22 +40,29 @@ func (c *Huggingface) Streaming() bool {
 	return c.streaming
 }
 
-func newHuggingface(model string) (*Huggingface, error) {
-	key := os.Getenv("HF_API_TOKEN")
-	if key == "" {
-		return nil, fmt.Errorf("HF_API_TOKEN not found")
+func newHuggingface(model string, keySpec string) (*Huggingface, error) {
+	key, err := newKeySource(keySpec, KeyEnvs["huggingface"])
+	if err != nil {
+		return nil, err
 	}
 	return &Huggingface{key: key, model: model}, nil
 }
 
-func (c *Huggingface) GetRequestBody(ctx splitter.ProjectContext) (map[string]interface{}, error) {
+func (c *Huggingface) GetRequestBody(ctx splitter.ProjectContext, sampling Sampling) (map[string]interface{}, error) {
 	parameters := map[string]interface{}{
-		"max_tokens":       32,
+		"max_new_tokens":   32,
 		"stream":           c.streaming,
 		"return_full_text": false,
 	}
+	sampling.apply(parameters, "max_new_tokens", "seed")
 
 	input := fmt.Sprintf("%s\n▁<PRE> %s ▁<SUF>%s ▁<MID>", ctx.File, ctx.Prefix, ctx.Suffix)
+	if c.template != nil {
+		var err error
+		if input, err = renderTemplate(c.template, ctx); err != nil {
+			return nil, err
+		}
+	}
 
 	data := map[string]interface{}{
 		"parameters": parameters,
@@ -65,8 +73,21 @@ func (c *Huggingface) GetRequestBody(ctx splitter.ProjectContext) (map[string]in
 	return data, nil
 }
 
-func (c *Huggingface) GetAuthHeader() string {
-	return "Bearer " + c.key
+func (c *Huggingface) SetTemplate(text string) error {
+	tmpl, err := parseTemplate("huggingface", text)
+	if err != nil {
+		return err
+	}
+	c.template = tmpl
+	return nil
+}
+
+func (c *Huggingface) Capabilities() Capabilities {
+	return Capabilities{MaxTemperature: 2, TopP: true, Seed: true, MaxStop: 4}
+}
+
+func (c *Huggingface) GetAuthHeader() (string, error) {
+	return bearer(c.key)
 }
 
 func (c *Huggingface) Endpoint() string {
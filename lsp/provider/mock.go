@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/festeh/llm_flow/lsp/provider/fake"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// Mock is a provider backed by an in-process fake server, for tests and
+// offline runs
+type Mock struct {
+	model     string
+	streaming bool
+	backend   *fake.Server
+}
+
+// MockResponse is the non-streaming Codestral wire format served by the fake
+type MockResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+func (r *MockResponse) Validate() error {
+	if len(r.Choices) == 0 {
+		return fmt.Errorf("no choices in response")
+	}
+	return nil
+}
+
+func (r *MockResponse) GetResult() string {
+	return r.Choices[0].Message.Content
+}
+
+// NewMock creates a mock provider serving scripted replies
+func NewMock(opts fake.Options, streaming bool) *Mock {
+	opts.Format = fake.Codestral
+	return &Mock{model: "mock", streaming: streaming, backend: fake.NewServer(opts)}
+}
+
+// newMock builds a mock from a model string in URL query form, e.g.
+// "text=return nil&delay=200ms&stream=false&status=500"
+func newMock(model string) (*Mock, error) {
+	query, err := url.ParseQuery(model)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mock model %q: %v", model, err)
+	}
+	reply := fake.Reply{Text: "mock completion"}
+	if query.Has("text") {
+		reply.Text = query.Get("text")
+	}
+	if d := query.Get("delay"); d != "" {
+		if reply.Delay, err = time.ParseDuration(d); err != nil {
+			return nil, fmt.Errorf("invalid mock delay: %v", err)
+		}
+	}
+	if st := query.Get("status"); st != "" {
+		if reply.Status, err = strconv.Atoi(st); err != nil {
+			return nil, fmt.Errorf("invalid mock status: %v", err)
+		}
+	}
+	opts := fake.Options{Replies: []fake.Reply{reply}}
+	if d := query.Get("chunk_delay"); d != "" {
+		if opts.ChunkDelay, err = time.ParseDuration(d); err != nil {
+			return nil, fmt.Errorf("invalid mock chunk delay: %v", err)
+		}
+	}
+	streaming := query.Get("stream") != "false"
+	m := NewMock(opts, streaming)
+	m.model = model
+	return m, nil
+}
+
+func (m *Mock) Name() string {
+	return "mock"
+}
+
+func (m *Mock) GetRequestBody(ctx splitter.ProjectContext, sampling Sampling) (map[string]interface{}, error) {
+	data := map[string]interface{}{
+		"model":  m.model,
+		"stream": m.streaming,
+		"prefix": ctx.Prefix,
+		"suffix": ctx.Suffix,
+	}
+	sampling.apply(data, "max_tokens", "seed")
+	return data, nil
+}
+
+func (m *Mock) GetChatRequestBody(messages []Message, sampling Sampling) (map[string]interface{}, error) {
+	return chatRequestBody(m.model, messages, sampling, "seed"), nil
+}
+
+// ChatEndpoint is the same fake backend, which answers chat requests with
+// its scripted replies
+func (m *Mock) ChatEndpoint() string {
+	return m.backend.URL
+}
+
+func (m *Mock) Capabilities() Capabilities {
+	return Capabilities{MaxTemperature: 2, TopP: true, Seed: true, MaxStop: 16}
+}
+
+func (m *Mock) GetAuthHeader() (string, error) {
+	return "Bearer mock", nil
+}
+
+func (m *Mock) Endpoint() string {
+	return m.backend.URL
+}
+
+func (m *Mock) SetModel(model string) {
+	m.model = model
+}
+
+func (m *Mock) IsStreaming() bool {
+	return m.streaming
+}
+
+func (m *Mock) NewResponse() Response {
+	return &MockResponse{}
+}
+
+// Backend exposes the fake server, e.g. to inspect received requests
+func (m *Mock) Backend() *fake.Server {
+	return m.backend
+}
+
+// Close stops the fake backend
+func (m *Mock) Close() {
+	m.backend.Close()
+}
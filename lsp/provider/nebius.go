@@ -2,17 +2,16 @@ package provider
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+	"text/template"
 
 	"github.com/festeh/llm_flow/lsp/splitter"
 )
 
 type Nebius struct {
-	key       string
+	key       KeySource
 	model     string
 	streaming bool
+	template  *template.Template
 }
 
 type NebiusResponse struct {
@@ -40,28 +39,31 @@ func (n *Nebius) Streaming() bool {
 	return n.streaming
 }
 
-func newNebius(model string) (*Nebius, error) {
-	key := os.Getenv("NEBIUS_API_KEY")
-	if key == "" {
-		return nil, fmt.Errorf("NEBIUS_API_KEY not found")
+func newNebius(model string, keySpec string) (*Nebius, error) {
+	key, err := newKeySource(keySpec, KeyEnvs["nebius"])
+	if err != nil {
+		return nil, err
 	}
 	return &Nebius{key: key, model: model}, nil
 }
 
-func (n *Nebius) GetRequestBody(ctx splitter.ProjectContext) (map[string]interface{}, error) {
+func (n *Nebius) GetRequestBody(ctx splitter.ProjectContext, sampling Sampling) (map[string]interface{}, error) {
 	repoName := "<|repo_name|>"
 	fileSep := "<|file_sep|>"
 	fimPrefix := "<|fim_prefix|>"
 	fimSuffix := "<|fim_suffix|>"
 	fimMiddle := "<|fim_middle|>"
-	repoBaseName := filepath.Base(ctx.Repo)
-	relativeFilePath := strings.TrimPrefix(ctx.File, ctx.Repo+"/")
 	prompt := fmt.Sprintf("%s%s\n%s%s\n%s%s%s%s%s",
-		repoName, repoBaseName,
-		fileSep, relativeFilePath,
+		repoName, ctx.RepoName(),
+		fileSep, ctx.RelativeFile(),
 		fimPrefix, ctx.Prefix,
 		fimSuffix, ctx.Suffix, fimMiddle)
-	fmt.Println(prompt)
+	if n.template != nil {
+		var err error
+		if prompt, err = renderTemplate(n.template, ctx); err != nil {
+			return nil, err
+		}
+	}
 	data := map[string]interface{}{
 		"max_tokens":  32,
 		"stream":      n.streaming,
@@ -70,11 +72,35 @@ func (n *Nebius) GetRequestBody(ctx splitter.ProjectContext) (map[string]interfa
 		"prompt":      prompt,
 		"stop":        []string{"<|file_sep|>"},
 	}
+	sampling.apply(data, "max_tokens", "seed")
 	return data, nil
 }
 
-func (n *Nebius) GetAuthHeader() string {
-	return "Bearer " + n.key
+func (n *Nebius) GetChatRequestBody(messages []Message, sampling Sampling) (map[string]interface{}, error) {
+	return chatRequestBody(n.model, messages, sampling, "seed"), nil
+}
+
+func (n *Nebius) ChatEndpoint() string {
+	return "https://api.studio.nebius.ai/v1/chat/completions"
+}
+
+// Capabilities leaves room for the file separator next to the configured
+// stop sequences, within the 4 the API accepts
+func (n *Nebius) Capabilities() Capabilities {
+	return Capabilities{MaxTemperature: 2, TopP: true, Seed: true, MaxStop: 3}
+}
+
+func (n *Nebius) SetTemplate(text string) error {
+	tmpl, err := parseTemplate("nebius", text)
+	if err != nil {
+		return err
+	}
+	n.template = tmpl
+	return nil
+}
+
+func (n *Nebius) GetAuthHeader() (string, error) {
+	return bearer(n.key)
 }
 
 func (n *Nebius) Endpoint() string {
@@ -0,0 +1,27 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// The API takes at most 4 stop sequences, the file separator included
+func TestNebiusStop(t *testing.T) {
+	n := &Nebius{model: "m"}
+	sampling := Sampling{Stop: []string{"\n\n", "}", "//"}}
+	if err := sampling.Validate(n.Name(), n.Capabilities()); err != nil {
+		t.Fatal(err)
+	}
+	body, err := n.GetRequestBody(splitter.ProjectContext{}, sampling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop := body["stop"].([]string); len(stop) != 4 || stop[0] != "<|file_sep|>" {
+		t.Errorf("got stop %q", stop)
+	}
+	sampling.Stop = append(sampling.Stop, ";")
+	if err := sampling.Validate(n.Name(), n.Capabilities()); err == nil {
+		t.Error("accepted a fifth stop sequence")
+	}
+}
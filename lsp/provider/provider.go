@@ -2,6 +2,10 @@ package provider
 
 import (
 	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/festeh/llm_flow/lsp/credentials"
 
 	"github.com/festeh/llm_flow/lsp/splitter"
 )
@@ -13,23 +17,139 @@ type Response interface {
 
 type Provider interface {
 	Name() string
-	GetRequestBody(splitter.ProjectContext) (map[string]interface{}, error)
-	GetAuthHeader() string
+	GetRequestBody(splitter.ProjectContext, Sampling) (map[string]interface{}, error)
+	GetAuthHeader() (string, error)
 	Endpoint() string
 	SetModel(string)
 	IsStreaming() bool
 	NewResponse() Response
+	Capabilities() Capabilities
+}
+
+// KeySource supplies the API key for every request, so keys can be rotated
+// without recreating the provider
+type KeySource interface {
+	Key() (string, error)
 }
 
-func NewProvider(name string, model string) (Provider, error) {
+// NewProvider creates the named provider. keySpec is a credentials spec
+// (see package credentials); empty means the provider's default env var and
+// keys file entry.
+func NewProvider(name string, model string, keySpec string) (Provider, error) {
 	switch name {
 	case "codestral":
-		return newCodestral()
+		return newCodestral(keySpec)
 	case "huggingface":
-		return newHuggingface(model)
-  case "nebius":
-    return newNebius(model)
+		return newHuggingface(model, keySpec)
+	case "nebius":
+		return newNebius(model, keySpec)
+	case "mock":
+		return newMock(model)
 	default:
 		return nil, fmt.Errorf("unknown provider: %s", name)
 	}
 }
+
+// KeyEnvs are the environment variables the providers document for their
+// API keys
+var KeyEnvs = map[string]string{
+	"codestral":   "CODESTRAL_API_KEY",
+	"huggingface": "HF_API_TOKEN",
+	"nebius":      "NEBIUS_API_KEY",
+}
+
+// newKeySource resolves spec, defaulting to envName, and checks that a key
+// is available right away
+func newKeySource(spec string, envName string) (KeySource, error) {
+	if spec == "" {
+		spec = credentials.Default(envName)
+	}
+	resolver, err := credentials.New(spec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := resolver.Key(); err != nil {
+		return nil, fmt.Errorf("%s not found: %v", envName, err)
+	}
+	return resolver, nil
+}
+
+func bearer(key KeySource) (string, error) {
+	k, err := key.Key()
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + k, nil
+}
+
+type endpointOverride struct {
+	Provider
+	endpoint string
+}
+
+func (e *endpointOverride) Endpoint() string {
+	return e.endpoint
+}
+
+// Close releases the wrapped provider
+func (e *endpointOverride) Close() {
+	if closer, ok := e.Provider.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// chatEndpointOverride keeps the chat API of a Chatter, sending its requests
+// to chatEndpoint
+type chatEndpointOverride struct {
+	*endpointOverride
+	chatter      Chatter
+	chatEndpoint string
+}
+
+func (e *chatEndpointOverride) ChatEndpoint() string {
+	return e.chatEndpoint
+}
+
+func (e *chatEndpointOverride) GetChatRequestBody(messages []Message, sampling Sampling) (map[string]interface{}, error) {
+	return e.chatter.GetChatRequestBody(messages, sampling)
+}
+
+// WithEndpoint returns p with requests sent to endpoint instead of the
+// provider's own URL. Chat requests go to chatEndpoint, or to endpoint too
+// when it is empty, so that none reach the provider's own host.
+func WithEndpoint(p Provider, endpoint, chatEndpoint string) Provider {
+	if endpoint == "" {
+		return p
+	}
+	override := &endpointOverride{Provider: p, endpoint: endpoint}
+	chatter, ok := p.(Chatter)
+	if !ok {
+		return override
+	}
+	if chatEndpoint == "" {
+		chatEndpoint = endpoint
+	}
+	return &chatEndpointOverride{endpointOverride: override, chatter: chatter, chatEndpoint: chatEndpoint}
+}
+
+// Templated providers build a text prompt whose layout can be overridden with
+// a text/template executed against splitter.ProjectContext
+type Templated interface {
+	SetTemplate(string) error
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+func renderTemplate(tmpl *template.Template, ctx splitter.ProjectContext) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, ctx); err != nil {
+		return "", fmt.Errorf("error rendering template: %v", err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,43 @@
+package provider
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/festeh/llm_flow/lsp/provider/fake"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+func TestWithEndpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		chatEndpoint string
+		want         string
+	}{
+		{name: "default", want: "http://proxy/fim"},
+		{name: "chat endpoint", chatEndpoint: "http://proxy/chat", want: "http://proxy/chat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := NewMock(fake.Options{}, false)
+			p := WithEndpoint(mock, "http://proxy/fim", tt.chatEndpoint)
+			if got := p.Endpoint(); got != "http://proxy/fim" {
+				t.Errorf("endpoint %q", got)
+			}
+			chat, err := Chat(p, func(splitter.ProjectContext) []Message { return nil }, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chat.Endpoint(); got != tt.want {
+				t.Errorf("chat endpoint %q, want %q", got, tt.want)
+			}
+
+			url := mock.Backend().URL
+			p.(interface{ Close() }).Close()
+			if resp, err := http.Get(url); err == nil {
+				resp.Body.Close()
+				t.Error("backend still serving after Close")
+			}
+		})
+	}
+}
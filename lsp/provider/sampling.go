@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"fmt"
+)
+
+// Sampling controls how a completion is generated. Zero values keep the
+// provider defaults.
+type Sampling struct {
+	MaxTokens   int      `json:"max_tokens,omitempty" toml:"max_tokens"`
+	Temperature *float64 `json:"temperature,omitempty" toml:"temperature"`
+	TopP        *float64 `json:"top_p,omitempty" toml:"top_p"`
+	Stop        []string `json:"stop,omitempty" toml:"stop"`
+	Seed        *int     `json:"seed,omitempty" toml:"seed"`
+	// Extra holds provider-specific fields added to the request as is
+	Extra map[string]interface{} `json:"extra,omitempty" toml:"extra"`
+}
+
+// Capabilities describe which sampling parameters a provider accepts
+type Capabilities struct {
+	// MaxTokens is the largest accepted max_tokens, 0 if unbounded
+	MaxTokens      int
+	MaxTemperature float64
+	TopP           bool
+	Seed           bool
+	// MaxStop is the number of stop sequences accepted, 0 if none
+	MaxStop int
+}
+
+// Merge returns s with the fields set in override replacing its own
+func (s Sampling) Merge(override Sampling) Sampling {
+	if override.MaxTokens != 0 {
+		s.MaxTokens = override.MaxTokens
+	}
+	if override.Temperature != nil {
+		s.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		s.TopP = override.TopP
+	}
+	if len(override.Stop) > 0 {
+		s.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		s.Seed = override.Seed
+	}
+	if len(override.Extra) > 0 {
+		extra := make(map[string]interface{}, len(s.Extra)+len(override.Extra))
+		for k, v := range s.Extra {
+			extra[k] = v
+		}
+		for k, v := range override.Extra {
+			extra[k] = v
+		}
+		s.Extra = extra
+	}
+	return s
+}
+
+// Validate checks s against what the provider supports
+func (s Sampling) Validate(name string, c Capabilities) error {
+	if s.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must be positive")
+	}
+	if c.MaxTokens > 0 && s.MaxTokens > c.MaxTokens {
+		return fmt.Errorf("%s accepts at most %d max_tokens", name, c.MaxTokens)
+	}
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > c.MaxTemperature) {
+		return fmt.Errorf("%s temperature must be between 0 and %g", name, c.MaxTemperature)
+	}
+	if s.TopP != nil {
+		if !c.TopP {
+			return fmt.Errorf("%s does not support top_p", name)
+		}
+		if *s.TopP <= 0 || *s.TopP > 1 {
+			return fmt.Errorf("top_p must be in (0, 1]")
+		}
+	}
+	if len(s.Stop) > c.MaxStop {
+		if c.MaxStop == 0 {
+			return fmt.Errorf("%s does not support stop sequences", name)
+		}
+		return fmt.Errorf("%s accepts at most %d stop sequences", name, c.MaxStop)
+	}
+	if s.Seed != nil && !c.Seed {
+		return fmt.Errorf("%s does not support seed", name)
+	}
+	return nil
+}
+
+// apply writes the set fields of s into a request body. maxTokensKey and
+// seedKey name those fields for the target API; stop sequences are appended
+// to any the provider already sends.
+func (s Sampling) apply(data map[string]interface{}, maxTokensKey string, seedKey string) {
+	if s.MaxTokens > 0 {
+		data[maxTokensKey] = s.MaxTokens
+	}
+	if s.Temperature != nil {
+		data["temperature"] = *s.Temperature
+	}
+	if s.TopP != nil {
+		data["top_p"] = *s.TopP
+	}
+	if len(s.Stop) > 0 {
+		stop, _ := data["stop"].([]string)
+		data["stop"] = append(append([]string(nil), stop...), s.Stop...)
+	}
+	if s.Seed != nil {
+		data[seedKey] = *s.Seed
+	}
+	for k, v := range s.Extra {
+		data[k] = v
+	}
+}
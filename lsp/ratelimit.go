@@ -0,0 +1,43 @@
+package lsp
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultBackOff pauses a provider that answered 429 without Retry-After
+const defaultBackOff = 2 * time.Second
+
+// acquire waits until the provider of route may take another request. key
+// identifies the document, so a newer request for it drops a queued one.
+func (s *Server) acquire(ctx context.Context, route Route, key string) (func(), error) {
+	name := route.Provider.Name()
+	logger := log.FromContext(ctx)
+	limiter := s.limiters.Get(name, route.Limits)
+	start := time.Now()
+	if depth := limiter.QueueDepth(); depth > 0 {
+		logger.Info("Waiting for provider", "queue", depth+1, "in_flight", limiter.InFlight())
+	}
+	release, err := limiter.Acquire(ctx, key)
+	if err != nil {
+		logger.Info("Dropped queued request", "reason", err, "queue", limiter.QueueDepth())
+		s.metrics.cancellations.Inc(name, "queued")
+		return nil, err
+	}
+	if waited := time.Since(start); waited > 10*time.Millisecond {
+		logger.Debug("Request released", "waited", waited, "queue", limiter.QueueDepth())
+	}
+	return release, nil
+}
+
+// backOff pauses the provider after it reported rate limiting
+func (s *Server) backOff(ctx context.Context, route Route, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = defaultBackOff
+	}
+	name := route.Provider.Name()
+	log.FromContext(ctx).Warn("Rate limited by provider", "provider", name, "retry_after", retryAfter)
+	s.limiters.Get(name, route.Limits).Pause(retryAfter)
+}
@@ -0,0 +1,275 @@
+// Package ratelimit keeps bursts of completions within provider limits: a
+// token bucket caps the request rate and a semaphore the requests in flight.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSuperseded is returned to a queued request when a newer one with the
+// same key joins the queue
+var ErrSuperseded = errors.New("superseded by a newer request")
+
+// Limits for one provider. Zero values mean unlimited.
+type Limits struct {
+	RequestsPerSecond float64 `toml:"requests_per_second" json:"requests_per_second,omitempty"`
+	// Burst is the number of requests allowed at once above the rate
+	Burst       int `toml:"burst" json:"burst,omitempty"`
+	MaxInFlight int `toml:"max_in_flight" json:"max_in_flight,omitempty"`
+}
+
+// IsSet reports whether any limit is configured
+func (l Limits) IsSet() bool {
+	return l.RequestsPerSecond > 0 || l.MaxInFlight > 0
+}
+
+// Stricter combines l with limits from a less trusted source, keeping the
+// stricter value of each, so that o may slow a provider down but never
+// speed it up
+func (l Limits) Stricter(o Limits) Limits {
+	l.RequestsPerSecond = stricter(l.RequestsPerSecond, o.RequestsPerSecond)
+	l.MaxInFlight = int(stricter(float64(l.MaxInFlight), float64(o.MaxInFlight)))
+	if l.Burst != 0 || o.Burst != 0 {
+		l.Burst = min(burst(l), burst(o))
+	}
+	return l
+}
+
+// stricter returns the smaller of two limits where 0 means unlimited
+func stricter(a, b float64) float64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Defaults apply to providers without configured limits
+var Defaults = map[string]Limits{
+	// The free tier answers bursts with 429s
+	"codestral": {RequestsPerSecond: 1, Burst: 2, MaxInFlight: 1},
+}
+
+type waiter struct {
+	key string
+	// dropped is closed when the waiter is superseded
+	dropped chan struct{}
+}
+
+// Limiter queues requests in order until both the rate and the in-flight
+// limits allow them through
+type Limiter struct {
+	mu       sync.Mutex
+	limits   Limits
+	tokens   float64
+	last     time.Time
+	inFlight int
+	queue    []*waiter
+	// changed is closed and replaced whenever a queued request might proceed
+	changed chan struct{}
+	// pausedUntil holds every request back, e.g. after the provider asked to
+	// retry later
+	pausedUntil time.Time
+}
+
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		tokens:  float64(burst(limits)),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func burst(limits Limits) int {
+	if limits.Burst > 0 {
+		return limits.Burst
+	}
+	return 1
+}
+
+// SetLimits changes the limits without dropping queued requests
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits == l.limits {
+		return
+	}
+	l.limits = limits
+	if max := float64(burst(limits)); l.tokens > max {
+		l.tokens = max
+	}
+	l.notify()
+}
+
+// Pause holds back every request for d
+func (l *Limiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.notify()
+}
+
+// QueueDepth is the number of requests waiting
+func (l *Limiter) QueueDepth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
+
+// InFlight is the number of requests let through and not yet released
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Acquire waits for the request's turn. A non-empty key, such as the document
+// being completed, drops any queued request with the same key. The returned
+// release must be called once the request is done.
+func (l *Limiter) Acquire(ctx context.Context, key string) (release func(), err error) {
+	w := &waiter{key: key, dropped: make(chan struct{})}
+	l.mu.Lock()
+	if key != "" {
+		kept := make([]*waiter, 0, len(l.queue))
+		for _, queued := range l.queue {
+			if queued.key == key {
+				close(queued.dropped)
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		l.queue = kept
+		l.notify()
+	}
+	l.queue = append(l.queue, w)
+	for {
+		wait, ok := l.ready(w)
+		if ok {
+			l.queue = l.queue[1:]
+			l.inFlight++
+			l.notify()
+			l.mu.Unlock()
+			return l.release, nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-w.dropped:
+			err = ErrSuperseded
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		l.mu.Lock()
+		if err != nil {
+			l.remove(w)
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+}
+
+// ready reports whether w may proceed, or else how long until the rate limit
+// might allow it (zero when only a release can)
+func (l *Limiter) ready(w *waiter) (time.Duration, bool) {
+	if len(l.queue) == 0 || l.queue[0] != w {
+		return 0, false
+	}
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now), false
+	}
+	if l.limits.MaxInFlight > 0 && l.inFlight >= l.limits.MaxInFlight {
+		return 0, false
+	}
+	if l.limits.RequestsPerSecond <= 0 {
+		return 0, true
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.limits.RequestsPerSecond
+	if max := float64(burst(l.limits)); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+	if l.tokens < 1 {
+		missing := (1 - l.tokens) / l.limits.RequestsPerSecond
+		return time.Duration(missing * float64(time.Second)), false
+	}
+	l.tokens--
+	return 0, true
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.notify()
+}
+
+func (l *Limiter) remove(w *waiter) {
+	for i, queued := range l.queue {
+		if queued == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			l.notify()
+			return
+		}
+	}
+}
+
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Set holds one limiter per provider
+type Set struct {
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+func NewSet() *Set {
+	return &Set{limiters: make(map[string]*Limiter)}
+}
+
+// Get returns the limiter for provider, creating it or updating its limits.
+// Without configured limits the provider's defaults are used.
+func (s *Set) Get(provider string, limits Limits) *Limiter {
+	if !limits.IsSet() {
+		limits = Defaults[strings.ToLower(provider)]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[provider]
+	if !ok {
+		l = New(limits)
+		s.limiters[provider] = l
+		return l
+	}
+	l.SetLimits(limits)
+	return l
+}
+
+// Each calls fn for every provider limiter
+func (s *Set) Each(fn func(provider string, l *Limiter)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, l := range s.limiters {
+		fn(name, l)
+	}
+}
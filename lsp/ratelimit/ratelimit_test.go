@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquireNow acquires l if it lets the request through right away
+func acquireNow(l *Limiter) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := l.Acquire(ctx, "")
+	return err == nil
+}
+
+func TestBurstAndRefill(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		// burst is the number of requests let through at once
+		burst int
+		// refill is the time until the next request, 0 when unlimited
+		refill time.Duration
+	}{
+		{name: "unlimited", limits: Limits{}, burst: 10},
+		{name: "default burst", limits: Limits{RequestsPerSecond: 10}, burst: 1, refill: 100 * time.Millisecond},
+		{name: "burst", limits: Limits{RequestsPerSecond: 10, Burst: 3}, burst: 3, refill: 100 * time.Millisecond},
+		{name: "slow", limits: Limits{RequestsPerSecond: 4, Burst: 2}, burst: 2, refill: 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.limits)
+			for i := 0; i < tt.burst; i++ {
+				if !acquireNow(l) {
+					t.Fatalf("request %d held back", i+1)
+				}
+			}
+			if tt.refill == 0 {
+				return
+			}
+			if acquireNow(l) {
+				t.Fatalf("request %d let through beyond the burst", tt.burst+1)
+			}
+			start := time.Now()
+			if _, err := l.Acquire(context.Background(), ""); err != nil {
+				t.Fatal(err)
+			}
+			// The failed attempt above already waited for part of the refill
+			if waited := time.Since(start); waited < tt.refill/2 || waited > tt.refill+time.Second {
+				t.Errorf("waited %v for a refill of %v", waited, tt.refill)
+			}
+		})
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	l := New(Limits{MaxInFlight: 2})
+	first, err := l.Acquire(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background(), "")
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("third request let through with two in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := l.QueueDepth(); depth != 1 {
+		t.Errorf("queue depth %d, want 1", depth)
+	}
+	first()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("release did not let the queued request through")
+	}
+	if n := l.InFlight(); n != 2 {
+		t.Errorf("%d in flight, want 2", n)
+	}
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		// block makes the next request wait
+		block func(l *Limiter)
+	}{
+		{name: "in flight", block: func(l *Limiter) {
+			l.SetLimits(Limits{MaxInFlight: 1})
+			l.Acquire(context.Background(), "")
+		}},
+		{name: "rate", block: func(l *Limiter) {
+			l.SetLimits(Limits{RequestsPerSecond: 0.01})
+			l.Acquire(context.Background(), "")
+		}},
+		{name: "paused", block: func(l *Limiter) {
+			l.Pause(time.Hour)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(Limits{})
+			tt.block(l)
+			ctx, cancel := context.WithCancel(context.Background())
+			acquired := make(chan error, 1)
+			go func() {
+				_, err := l.Acquire(ctx, "")
+				acquired <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+			select {
+			case err := <-acquired:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("got %v, want context.Canceled", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("cancelled request still waiting")
+			}
+			if depth := l.QueueDepth(); depth != 0 {
+				t.Errorf("cancelled request left in the queue (depth %d)", depth)
+			}
+		})
+	}
+}
+
+func TestSuperseded(t *testing.T) {
+	l := New(Limits{MaxInFlight: 1})
+	if _, err := l.Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background(), "a.go")
+		acquired <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go l.Acquire(context.Background(), "a.go")
+	select {
+	case err := <-acquired:
+		if !errors.Is(err, ErrSuperseded) {
+			t.Fatalf("got %v, want ErrSuperseded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued request not dropped by a newer one for the same key")
+	}
+}
+
+func TestStricter(t *testing.T) {
+	tests := []struct {
+		name       string
+		base, less Limits
+		want       Limits
+	}{
+		{name: "looser", base: Limits{RequestsPerSecond: 1, Burst: 2, MaxInFlight: 1}, less: Limits{RequestsPerSecond: 10, Burst: 20, MaxInFlight: 5}, want: Limits{RequestsPerSecond: 1, Burst: 2, MaxInFlight: 1}},
+		{name: "tighter", base: Limits{RequestsPerSecond: 1, Burst: 2}, less: Limits{RequestsPerSecond: 0.5, Burst: 1, MaxInFlight: 1}, want: Limits{RequestsPerSecond: 0.5, Burst: 1, MaxInFlight: 1}},
+		{name: "unlimited base", less: Limits{RequestsPerSecond: 2}, want: Limits{RequestsPerSecond: 2}},
+		{name: "default burst", base: Limits{RequestsPerSecond: 1}, less: Limits{Burst: 5}, want: Limits{RequestsPerSecond: 1, Burst: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.base.Stricter(tt.less); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
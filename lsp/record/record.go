@@ -0,0 +1,108 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// Entry is one recorded provider round trip
+type Entry struct {
+	Time      time.Time               `json:"time"`
+	Provider  string                  `json:"provider"`
+	Model     string                  `json:"model,omitempty"`
+	Context   splitter.ProjectContext `json:"context"`
+	Sampling  provider.Sampling       `json:"sampling"`
+	Request   map[string]interface{}  `json:"request"`
+	Response  string                  `json:"response"`
+	Result    string                  `json:"result"`
+	LatencyMs int64                   `json:"latency_ms"`
+	Error     string                  `json:"error,omitempty"`
+}
+
+// Messages returns the conversation a chat flow sent, as carried by its
+// request, or nil for completion flows
+func (e Entry) Messages() ([]provider.Message, error) {
+	raw, ok := e.Request["messages"]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error reading messages: %v", err)
+	}
+	var messages []provider.Message
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("error parsing messages: %v", err)
+	}
+	return messages, nil
+}
+
+// Streamed reports whether the answer was asked for as a stream
+func (e Entry) Streamed() bool {
+	stream, _ := e.Request["stream"].(bool)
+	return stream
+}
+
+// Recorder appends entries to a JSONL file
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func Open(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating recording dir: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording file: %v", err)
+	}
+	return &Recorder{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends an entry. A nil recorder silently drops it.
+func (r *Recorder) Record(e Entry) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(e)
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// Read parses all entries of a recording
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error parsing entry %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,57 @@
+package record
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/festeh/llm_flow/lsp/provider"
+)
+
+func TestMessages(t *testing.T) {
+	messages := []provider.Message{
+		{Role: "system", Content: "Rewrite the selection."},
+		{Role: "user", Content: "var x = 1"},
+	}
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{
+		{Provider: "mock", Request: map[string]interface{}{"messages": messages, "stream": true}},
+		{Provider: "mock", Request: map[string]interface{}{"prefix": "package a\n"}},
+	}
+	for _, e := range entries {
+		if err := r.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("read %d entries, want 2", len(read))
+	}
+
+	got, err := read[0].Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, messages) || !read[0].Streamed() {
+		t.Errorf("chat entry replays %+v (stream %v)", got, read[0].Streamed())
+	}
+	if got, err := read[1].Messages(); err != nil || got != nil {
+		t.Errorf("completion entry has messages %+v (%v)", got, err)
+	}
+}
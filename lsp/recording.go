@@ -0,0 +1,75 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/record"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// SetRecorder enables recording of every provider round trip
+func (s *Server) SetRecorder(r *record.Recorder) {
+	s.recorder = r
+}
+
+// flow runs Flow against the provider of route, accounting its usage and
+// recording the exchange when a recorder is set. While it waits for the
+// provider, a newer flow with the same non-empty key drops it: completions
+// use their document, rewrites no key so that keystrokes leave them be.
+func (s *Server) flow(ctx context.Context, route Route, pc splitter.ProjectContext, key string, w io.Writer) (string, error) {
+	if !s.startFlow() {
+		return "", errShuttingDown
+	}
+	defer s.flows.Done()
+	p := route.Provider
+	ctx = log.WithContext(ctx, log.FromContext(ctx).With("provider", p.Name()))
+	pc, counts := route.Redactor.Context(pc)
+	if len(counts) > 0 {
+		log.FromContext(ctx).Info("Redacted secrets", "counts", counts)
+	}
+	release, err := s.acquire(ctx, route, key)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	var trace FlowTrace
+	start := time.Now()
+	result, err := TracedFlow(p, pc, route.Sampling, ctx, w, &trace)
+	elapsed := time.Since(start)
+	s.metrics.observeFlow(ctx, p.Name(), &trace, elapsed, err)
+	log.FromContext(ctx).Info("Provider responded", "first_token", trace.FirstToken, "elapsed", elapsed, "error", err)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		s.backOff(ctx, route, statusErr.RetryAfter)
+	}
+	// Cancelled requests are billed too once the provider started answering
+	if err == nil || (ctx.Err() != nil && trace.Response.Len() > 0) {
+		s.account(ctx, route, trace.Request, result, trace.Usage)
+	}
+	if s.recorder == nil {
+		return result, err
+	}
+	entry := record.Entry{
+		Time:      start,
+		Provider:  p.Name(),
+		Model:     route.Model,
+		Context:   pc,
+		Sampling:  route.Sampling,
+		Request:   trace.Request,
+		Response:  trace.Response.String(),
+		Result:    result,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if recErr := s.recorder.Record(entry); recErr != nil {
+		log.FromContext(ctx).Error("Recording", "error", recErr)
+	}
+	return result, err
+}
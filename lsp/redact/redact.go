@@ -0,0 +1,196 @@
+// Package redact masks secrets in code before it is sent to a provider.
+package redact
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// Mask replaces every redacted secret
+const Mask = "[REDACTED]"
+
+// Rule masks matches of Pattern. If the pattern has a group named "secret",
+// only that group is masked so the surrounding assignment stays readable.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+var defaultRules = []Rule{
+	{"private_key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z ]*PRIVATE KEY-----|\z)`)},
+	{"aws_access_key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"aws_secret_key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`)},
+	{"github_token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`)},
+	{"slack_token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"api_key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}`)},
+}
+
+// Files that are never sent to a provider
+var defaultDeny = []string{
+	".env", ".env.*", "*.env",
+	"*.pem", "*.key", "*.p12", "*.pfx", "*.kdbx",
+	"id_rsa*", "id_ecdsa*", "id_ed25519*",
+	".netrc", ".npmrc", ".pypirc", ".git-credentials",
+	"credentials", "credentials.json", "secrets.*",
+}
+
+// Candidates for the entropy check: long runs of token-ish characters
+var tokenPattern = regexp.MustCompile(`[A-Za-z0-9+/=_\-]{20,}`)
+
+type Options struct {
+	// Patterns are extra rules by name
+	Patterns map[string]string `toml:"patterns"`
+	// Deny are extra file globs for which completions are never requested
+	Deny []string `toml:"deny"`
+	// Entropy enables masking of high-entropy strings (default true)
+	Entropy *bool `toml:"entropy"`
+}
+
+type Redactor struct {
+	rules   []Rule
+	deny    []string
+	entropy bool
+}
+
+// Default redacts built-in secret formats and high-entropy strings
+func Default() *Redactor {
+	r, _ := New(Options{})
+	return r
+}
+
+func New(opts Options) (*Redactor, error) {
+	r := &Redactor{
+		rules:   append([]Rule(nil), defaultRules...),
+		deny:    append(append([]string(nil), defaultDeny...), opts.Deny...),
+		entropy: opts.Entropy == nil || *opts.Entropy,
+	}
+	names := make([]string, 0, len(opts.Patterns))
+	for name := range opts.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(opts.Patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %s: %v", name, err)
+		}
+		r.rules = append(r.rules, Rule{Name: name, Pattern: re})
+	}
+	for _, glob := range r.deny {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid deny glob %q: %v", glob, err)
+		}
+	}
+	return r, nil
+}
+
+// Denied reports whether file (inside repo) must never be sent
+func (r *Redactor) Denied(repo, file string) bool {
+	base := filepath.Base(file)
+	rel := strings.TrimPrefix(file, repo+"/")
+	for _, glob := range r.deny {
+		if ok, _ := filepath.Match(glob, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact masks secrets in text and adds the number of masked secrets per
+// rule to counts
+func (r *Redactor) Redact(text string, counts map[string]int) string {
+	for _, rule := range r.rules {
+		text = maskRule(rule, text, counts)
+	}
+	if r.entropy {
+		text = tokenPattern.ReplaceAllStringFunc(text, func(token string) string {
+			if !looksRandom(token) {
+				return token
+			}
+			counts["high_entropy"]++
+			return Mask
+		})
+	}
+	return text
+}
+
+func maskRule(rule Rule, text string, counts map[string]int) string {
+	group := rule.Pattern.SubexpIndex("secret")
+	matches := rule.Pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if group > 0 && m[2*group] >= 0 {
+			start, end = m[2*group], m[2*group+1]
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(Mask)
+		last = end
+		counts[rule.Name]++
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// Context redacts prefix and suffix of ctx and returns the counts per rule
+func (r *Redactor) Context(ctx splitter.ProjectContext) (splitter.ProjectContext, map[string]int) {
+	counts := make(map[string]int)
+	ctx.Prefix = r.Redact(ctx.Prefix, counts)
+	ctx.Suffix = r.Redact(ctx.Suffix, counts)
+	ctx.Edits = r.Redact(ctx.Edits, counts)
+	ctx.Selection = r.Redact(ctx.Selection, counts)
+	return ctx, counts
+}
+
+// looksRandom flags tokens that mix letters and digits and have a Shannon
+// entropy typical of keys rather than identifiers or words
+func looksRandom(token string) bool {
+	var upper, lower, digit bool
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+	}
+	if !digit || !(upper || lower) {
+		return false
+	}
+	threshold := 4.2
+	if !upper || !lower {
+		// hex and other single-case alphabets carry less entropy per char
+		threshold = 3.4
+	}
+	return entropy(token) >= threshold
+}
+
+func entropy(s string) float64 {
+	freq := make(map[rune]int)
+	for _, c := range s {
+		freq[c]++
+	}
+	n := float64(len(s))
+	var h float64
+	for _, count := range freq {
+		p := float64(count) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
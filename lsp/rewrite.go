@@ -0,0 +1,263 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/document"
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/splitter"
+)
+
+// RewriteCommand is the workspace/executeCommand counterpart of
+// llm_flow/rewrite, taking RewriteParams as its only argument
+const RewriteCommand = "llm_flow.rewrite"
+
+// rewriteMaxTokens is the least token budget of a rewrite; longer
+// selections get twice their estimated length
+const rewriteMaxTokens = 1024
+
+const rewriteInstructions = `You rewrite a selection of code as the programmer instructs. Change only what the instruction asks for, keep the indentation and style of the code, and keep it consistent with the code around it.
+
+Answer with only the rewritten selection in a single fenced code block, without explanation.`
+
+var fencePattern = regexp.MustCompile("(?s)```[^\n]*\n(.*?)\n?```")
+
+// RewriteParams asks to rewrite a range of a document following a natural
+// language instruction
+type RewriteParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Range        Range                  `json:"range"`
+	Instruction  string                 `json:"instruction"`
+	// WorkDoneToken, when set, receives $/progress reports
+	WorkDoneToken *ID `json:"workDoneToken,omitempty"`
+}
+
+// HandleRewrite answers llm_flow/rewrite with the edit replacing the range
+func (s *Server) HandleRewrite(ctx context.Context, raw json.RawMessage) (*WorkspaceEdit, error) {
+	var params RewriteParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+	return s.rewrite(ctx, params)
+}
+
+// HandleExecuteCommand runs a command of workspace/executeCommand. The edit
+// it makes is pushed with workspace/applyEdit when the client supports it,
+// and returned otherwise.
+func (s *Server) HandleExecuteCommand(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var params ExecuteCommandParams
+	if err := decodeParams(raw, &params); err != nil {
+		return nil, err
+	}
+	if params.Command != RewriteCommand && params.Command != CodeActionCommand {
+		return nil, newError(InvalidParams, "unknown command: %s", params.Command)
+	}
+	if len(params.Arguments) != 1 {
+		return nil, newError(InvalidParams, "%s takes one argument, got %d", params.Command, len(params.Arguments))
+	}
+	var edit *WorkspaceEdit
+	var label string
+	var err error
+	if params.Command == RewriteCommand {
+		var rewrite RewriteParams
+		if err := decodeParams(params.Arguments[0], &rewrite); err != nil {
+			return nil, err
+		}
+		label = "Rewrite: " + rewrite.Instruction
+		edit, err = s.rewrite(ctx, rewrite)
+	} else {
+		var data codeActionData
+		if err := decodeParams(params.Arguments[0], &data); err != nil {
+			return nil, err
+		}
+		label, edit, err = s.resolveCodeAction(ctx, data)
+	}
+	if err != nil || !s.capabilities(ctx).Workspace.ApplyEdit {
+		return edit, err
+	}
+	answer, err := s.call(ctx, "workspace/applyEdit", ApplyWorkspaceEditParams{
+		Label: label,
+		Edit:  *edit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result ApplyWorkspaceEditResult
+	if err := json.Unmarshal(answer, &result); err != nil {
+		return nil, fmt.Errorf("error parsing applyEdit result: %v", err)
+	}
+	if !result.Applied {
+		return nil, fmt.Errorf("edit not applied: %s", result.FailureReason)
+	}
+	return nil, nil
+}
+
+// rewrite asks a chat model to rewrite the selection of params, reporting
+// its progress, and returns the edit replacing it
+func (s *Server) rewrite(ctx context.Context, params RewriteParams) (*WorkspaceEdit, error) {
+	g, err := s.generate(ctx, params, rewriteInstructions, "Rewriting selection")
+	if err != nil {
+		return nil, err
+	}
+	rewritten := g.code
+	if strings.HasSuffix(g.selection(), "\n") && !strings.HasSuffix(rewritten, "\n") {
+		rewritten += "\n"
+	}
+	encoding := s.positionEncoding(ctx)
+	version := g.doc.Version
+	return s.workspaceEdit(ctx, g.doc.URI, &version, TextEdit{
+		Range:   offsetRange(g.doc, g.start, g.end, encoding),
+		NewText: rewritten,
+	}), nil
+}
+
+// generated is the code a chat model wrote for a selection
+type generated struct {
+	doc *document.Snapshot
+	// start and end delimit the selection
+	start, end int
+	code       string
+}
+
+func (g *generated) selection() string {
+	return g.doc.Text()[g.start:g.end]
+}
+
+// generate sends the selection of params with its surroundings and
+// instruction to a chat model told what to answer by system, reporting its
+// progress under title, and returns the code of the answer
+func (s *Server) generate(ctx context.Context, params RewriteParams, system, title string) (*generated, error) {
+	uri := params.TextDocument.URI
+	if strings.TrimSpace(params.Instruction) == "" {
+		return nil, newError(InvalidParams, "instruction is empty")
+	}
+	logger := log.FromContext(ctx).With("uri", uri)
+	ctx = log.WithContext(ctx, logger)
+	logger.Info("got rewrite", "range", params.Range, "instruction", params.Instruction)
+
+	doc, exists := s.snapshot(ctx, uri)
+	if !exists {
+		return nil, fmt.Errorf("document not found: %s", uri)
+	}
+	route, err := s.routeFor(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if route.Provider == nil {
+		return nil, fmt.Errorf("Provider not set")
+	}
+	filePath := uriToPath(uri)
+	if route.Redactor.Denied(route.Repo, filePath) {
+		return nil, newError(InvalidRequest, "rewrites are disabled for %s", filePath)
+	}
+	encoding := s.positionEncoding(ctx)
+	start, err := doc.Offset(params.Range.Start.Line, params.Range.Start.Character, encoding)
+	if err != nil {
+		return nil, newError(InvalidParams, "%v", err)
+	}
+	end, err := doc.Offset(params.Range.End.Line, params.Range.End.Character, encoding)
+	if err != nil {
+		return nil, newError(InvalidParams, "%v", err)
+	}
+	text := doc.Text()
+	if end < start || strings.TrimSpace(text[start:end]) == "" {
+		return nil, newError(InvalidParams, "selection is empty")
+	}
+	selection := text[start:end]
+	// A masked secret would be written back into the file
+	if route.Redactor.Redact(selection, make(map[string]int)) != selection {
+		return nil, newError(InvalidRequest, "selection contains secrets")
+	}
+
+	chat, err := provider.Chat(route.Provider, rewritePrompt(system, params.Instruction), true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot rewrite: %v", err)
+	}
+	route.Provider = chat
+	route.Sampling = rewriteSampling(route, selection)
+	pc := splitter.ProjectContext{
+		Repo:      route.Repo,
+		File:      filePath,
+		Prefix:    text[:start],
+		Suffix:    text[end:],
+		Selection: selection,
+	}
+	pc = pc.Trim(route.ContextBudget)
+
+	progress := s.beginProgress(ctx, params.WorkDoneToken, title)
+	answer, err := s.flow(ctx, route, pc, "", progress)
+	if err != nil {
+		progress.end("Failed")
+		return nil, err
+	}
+	progress.end("Done")
+	return &generated{doc: doc, start: start, end: end, code: extractCode(answer)}, nil
+}
+
+// workspaceEdit applies edits to the document at uri, naming its version
+// when the client supports it so that the client refuses the edits if the
+// document changed meanwhile. version is nil for files that are not open.
+func (s *Server) workspaceEdit(ctx context.Context, uri string, version *int, edits ...TextEdit) *WorkspaceEdit {
+	if s.capabilities(ctx).Workspace.WorkspaceEdit.DocumentChanges {
+		return &WorkspaceEdit{DocumentChanges: []interface{}{TextDocumentEdit{
+			TextDocument: OptionalVersionedTextDocumentIdentifier{URI: uri, Version: version},
+			Edits:        edits,
+		}}}
+	}
+	return &WorkspaceEdit{Changes: map[string][]TextEdit{uri: edits}}
+}
+
+func rewritePrompt(system, instruction string) provider.Prompt {
+	return func(ctx splitter.ProjectContext) []provider.Message {
+		var b strings.Builder
+		fmt.Fprintf(&b, "File: %s\n\n", ctx.RelativeFile())
+		fmt.Fprintf(&b, "Code before the selection:\n```\n%s\n```\n\n", ctx.Prefix)
+		fmt.Fprintf(&b, "Selection:\n```\n%s\n```\n\n", ctx.Selection)
+		fmt.Fprintf(&b, "Code after the selection:\n```\n%s\n```\n\n", ctx.Suffix)
+		fmt.Fprintf(&b, "Instruction: %s", instruction)
+		return []provider.Message{
+			{Role: "system", Content: system},
+			{Role: "user", Content: b.String()},
+		}
+	}
+}
+
+func rewriteSampling(route Route, selection string) provider.Sampling {
+	// About four bytes per token, and room for the rewrite to grow
+	sampling := provider.Sampling{
+		MaxTokens:   max(rewriteMaxTokens, len(selection)/2),
+		Temperature: route.Sampling.Temperature,
+		Seed:        route.Sampling.Seed,
+	}
+	if limit := route.Provider.Capabilities().MaxTokens; limit > 0 {
+		sampling.MaxTokens = min(sampling.MaxTokens, limit)
+	}
+	return sampling
+}
+
+// extractCode returns the content of the first fenced code block of answer,
+// or answer itself if it has none
+func extractCode(answer string) string {
+	if match := fencePattern.FindStringSubmatch(answer); match != nil {
+		return match[1]
+	}
+	return trimBlankLines(answer)
+}
+
+// trimBlankLines drops the blank lines around text, keeping the indentation
+// of its first line
+func trimBlankLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
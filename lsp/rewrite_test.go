@@ -0,0 +1,23 @@
+package lsp
+
+import "testing"
+
+func TestExtractCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer string
+		want   string
+	}{
+		{name: "fenced", answer: "Sure:\n```go\n\tx := 1\n```\nDone.", want: "\tx := 1"},
+		{name: "first fence", answer: "```\na\n```\n```\nb\n```", want: "a"},
+		{name: "indented", answer: "\tif err != nil {\n\t\treturn err\n\t}\n", want: "\tif err != nil {\n\t\treturn err\n\t}"},
+		{name: "blank lines", answer: "\n  \n    x := 1\n\n", want: "    x := 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractCode(tt.answer); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,57 +2,191 @@ package lsp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/document"
+	"github.com/festeh/llm_flow/lsp/ratelimit"
+	"github.com/festeh/llm_flow/lsp/record"
+	"github.com/festeh/llm_flow/lsp/telemetry"
+	"github.com/festeh/llm_flow/lsp/usage"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Server represents an LSP server instance
 type Server struct {
-	config            Config
-	documents         map[string]string
-	writer            io.Writer
-	mu                sync.Mutex
-	clients           map[net.Conn]struct{}
-	activePredictions map[int]context.CancelFunc
-	predictionsMu     sync.Mutex
+	documents *document.Store
+	// out is where messages without a connection, e.g. from HandleMessage
+	// callers, are written to
+	out       *connection
+	mu        sync.Mutex
+	clients   map[net.Conn]*connection
+	telemetry *telemetry.Store
+	recorder  *record.Recorder
+	usage     *usage.Store
+	limiters  *ratelimit.Set
+	metrics   *serverMetrics
+	// nextConnID numbers connections for log correlation
+	nextConnID atomic.Int64
+	// nextProgress numbers the progress tokens the server creates
+	nextProgress atomic.Int64
+	// shutdown is set once the process is shutting down, unlike the
+	// shutdown of one client of a shared server
+	shutdown atomic.Bool
+	// flows counts in-flight provider calls, drained on shutdown. flowsMu
+	// orders counting a call in with setting shutdown.
+	flows    sync.WaitGroup
+	flowsMu  sync.Mutex
+	exited   chan struct{}
+	exitOnce sync.Once
+	exitCode int
+	shared   bool
+	// token, when set, authenticates network clients
+	token     TokenSource
+	tlsConfig *tls.Config
+	// allowedOrigins may open WebSocket connections besides same-origin pages
+	allowedOrigins []string
 }
 
 // NewServer creates a new LSP server instance
 func NewServer(w io.Writer) *Server {
-	return &Server{
-		config:            Config{},
-		documents:         make(map[string]string),
-		writer:            w,
-		clients:           make(map[net.Conn]struct{}),
-		activePredictions: make(map[int]context.CancelFunc),
+	s := &Server{
+		documents: document.NewStore(),
+		out:       newConnection(w, nil),
+		clients:   make(map[net.Conn]*connection),
+		usage:     usage.NewMemoryStore(),
+		limiters:  ratelimit.NewSet(),
+		exited:    make(chan struct{}),
 	}
+	s.metrics = newServerMetrics(s)
+	return s
 }
 
 type PredictEditorParams struct {
 	URI  string `json:"uri"`
 	Line int    `json:"line"`
-	Pos  int    `json:"pos"`
+	// Pos is the character of the cursor, in the negotiated position encoding
+	Pos int `json:"pos"`
+	// Mode is ModeLine, the default, ModeBlock or ModeNextEdit
+	Mode string `json:"mode,omitempty"`
 }
 
 type Header struct {
-	Method string          `json:"method"`
-	ID     int             `json:"id,omitempty"`
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	// ID is nil for notifications
+	ID     *ID             `json:"id,omitempty"`
 	Params json.RawMessage `json:"params"`
+	// Result and Error are set on responses to server-initiated requests
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ResponseError  `json:"error,omitempty"`
 }
 
-// HandleMessage processes a single LSP message
+// HandleMessage processes a single LSP message, waiting for its handler
 func (s *Server) HandleMessage(ctx context.Context, message []byte) error {
-	// Parse the JSON-RPC message
+	header, err := s.decodeMessage(ctx, message)
+	if err != nil {
+		return err
+	}
+	if header.Method == "" {
+		s.handleCallResponse(ctx, *header)
+		return nil
+	}
+	if header.ID != nil {
+		var done func()
+		ctx, done = s.trackRequest(ctx, *header.ID)
+		defer done()
+	}
+	return s.handle(ctx, *header)
+}
+
+// decodeMessage parses and validates a message, answering invalid ones. A
+// message without method is a response to a server-initiated request.
+func (s *Server) decodeMessage(ctx context.Context, message []byte) (*Header, error) {
+	trimmed := bytes.TrimSpace(message)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		s.sendError(ctx, nil, newError(InvalidRequest, "batch requests are not supported"))
+		return nil, fmt.Errorf("batch requests are not supported")
+	}
 	var header Header
-	header.ID = -1
 	if err := json.Unmarshal(message, &header); err != nil {
-		return fmt.Errorf("error parsing message: %v", err)
+		s.sendError(ctx, nil, newError(ParseError, "error parsing message: %v", err))
+		return nil, fmt.Errorf("error parsing message: %v", err)
+	}
+	if header.JSONRPC != "2.0" {
+		s.sendError(ctx, header.ID, newError(InvalidRequest, "jsonrpc must be \"2.0\""))
+		return nil, fmt.Errorf("invalid jsonrpc version: %q", header.JSONRPC)
+	}
+	if header.Method == "" && (header.ID == nil || (header.Result == nil && header.Error == nil)) {
+		s.sendError(ctx, header.ID, newError(InvalidRequest, "message has no method"))
+		return nil, fmt.Errorf("message has no method")
+	}
+	return &header, nil
+}
+
+// handledMethods are the methods handle serves. The metrics count any other
+// method as "other", so that clients can't add labels at will.
+var handledMethods = map[string]bool{
+	"initialize":                       true,
+	"initialized":                      true,
+	"shutdown":                         true,
+	"exit":                             true,
+	"$/cancelRequest":                  true,
+	"cancel_predict_editor":            true,
+	"textDocument/didOpen":             true,
+	"textDocument/didChange":           true,
+	"textDocument/didClose":            true,
+	"textDocument/didSave":             true,
+	"textDocument/completion":          true,
+	"predict_editor":                   true,
+	"predict_editor/shown":             true,
+	"predict_editor/accepted":          true,
+	"predict_editor/rejected":          true,
+	"workspace/didChangeConfiguration": true,
+	"set_config":                       true,
+	"predict":                          true,
+	"llm_flow/usage":                   true,
+	"llm_flow/rewrite":                 true,
+	"workspace/executeCommand":         true,
+	"textDocument/codeAction":          true,
+	"codeAction/resolve":               true,
+}
+
+// handle runs the handler of a request or notification and answers
+// requests. Requests are expected to be tracked already.
+func (s *Server) handle(ctx context.Context, header Header) error {
+	method := header.Method
+	if !handledMethods[method] {
+		method = "other"
+	}
+	defer s.metrics.messages.Inc(method)
+	logger := log.FromContext(ctx).With("method", header.Method)
+	if header.ID != nil {
+		logger = logger.With("request", header.ID.String())
+	}
+	ctx = log.WithContext(ctx, logger)
+
+	c := s.connFrom(ctx)
+	if !c.initialized.Load() && header.Method != "initialize" {
+		if header.ID != nil {
+			return s.sendError(ctx, header.ID, newError(ServerNotInitialized, "server not initialized"))
+		}
+		if header.Method != "exit" {
+			logger.Warn("Dropping notification before initialize")
+			return nil
+		}
+	}
+	if (c.shutdown.Load() || s.shutdown.Load()) && header.ID != nil {
+		return s.sendError(ctx, header.ID, newError(InvalidRequest, "server is shutting down"))
 	}
 
 	// Handle different methods
@@ -62,8 +196,9 @@ func (s *Server) HandleMessage(ctx context.Context, message []byte) error {
 	switch header.Method {
 	case "initialize":
 		var params InitializeParams
-		json.Unmarshal(header.Params, &params)
-		result, handleErr = s.Initialize(ctx, &params)
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			result, handleErr = s.Initialize(ctx, &params)
+		}
 
 	case "initialized":
 		handleErr = s.Initialized(ctx)
@@ -74,64 +209,120 @@ func (s *Server) HandleMessage(ctx context.Context, message []byte) error {
 	case "exit":
 		handleErr = s.Exit(ctx)
 
+	case "$/cancelRequest", "cancel_predict_editor":
+		var params CancelParams
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			s.cancelRequest(ctx, params.ID)
+		}
+
 	case "textDocument/didOpen":
 		var params DidOpenTextDocumentParams
-		json.Unmarshal(header.Params, &params)
-		handleErr = s.TextDocumentDidOpen(ctx, &params)
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			handleErr = s.TextDocumentDidOpen(ctx, &params)
+		}
 
 	case "textDocument/didChange":
 		var params DidChangeTextDocumentParams
-		json.Unmarshal(header.Params, &params)
-		handleErr = s.TextDocumentDidChange(ctx, &params)
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			handleErr = s.TextDocumentDidChange(ctx, &params)
+		}
+
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			handleErr = s.TextDocumentDidClose(ctx, &params)
+		}
 
 	case "textDocument/didSave":
 		var params DidSaveTextDocumentParams
-		// log.Info("", "rawParams", string(header.Params))
-		json.Unmarshal(header.Params, &params)
-		handleErr = s.TextDocumentDidSave(ctx, &params)
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			handleErr = s.TextDocumentDidSave(ctx, &params)
+		}
 
 	case "textDocument/completion":
 		result, handleErr = s.TextDocumentCompletion(ctx, header.Params)
 
-	case "cancel_predict_editor":
-		s.HandleCancelPredictEditor(header)
-
 	case "predict_editor":
-		return s.HandlePredictEditor(header, ctx)
+		result, handleErr = s.HandlePredictEditor(header, ctx)
 
+	case "predict_editor/shown":
+		handleErr = s.HandlePredictionFeedback(ctx, telemetry.Shown, header.Params)
+
+	case "predict_editor/accepted":
+		handleErr = s.HandlePredictionFeedback(ctx, telemetry.Accepted, header.Params)
+
+	case "predict_editor/rejected":
+		handleErr = s.HandlePredictionFeedback(ctx, telemetry.Rejected, header.Params)
+
+	case "workspace/didChangeConfiguration":
+		var params DidChangeConfigurationParams
+		if handleErr = decodeParams(header.Params, &params); handleErr == nil {
+			handleErr = s.WorkspaceDidChangeConfiguration(ctx, &params)
+		}
+
+	// set_config predates workspace/didChangeConfiguration and is kept as an alias
 	case "set_config":
-		return s.config.HandleSetConfig(header.Params)
+		handleErr = c.config.HandleSetConfig(ctx, header.Params)
 
 	case "predict":
-		return s.HandlePredictRequest(ctx, header.Params, header)
+		handleErr = s.HandlePredictRequest(ctx, header.Params, header)
+
+	case "llm_flow/usage":
+		result, handleErr = s.HandleUsage(ctx, header.Params)
+
+	case "llm_flow/rewrite":
+		result, handleErr = s.HandleRewrite(ctx, header.Params)
+
+	case "workspace/executeCommand":
+		result, handleErr = s.HandleExecuteCommand(ctx, header.Params)
+
+	case "textDocument/codeAction":
+		result, handleErr = s.HandleCodeAction(ctx, header.Params)
+
+	case "codeAction/resolve":
+		result, handleErr = s.HandleCodeActionResolve(ctx, header.Params)
 
 	default:
-		return fmt.Errorf("unknown method: %s", header.Method)
+		if header.ID == nil {
+			// Unknown notifications, such as optional $/ ones, are ignored
+			logger.Debug("Ignoring notification")
+			return nil
+		}
+		handleErr = newError(MethodNotFound, "unknown method: %s", header.Method)
 	}
 
 	// Send response for requests (methods with IDs)
-	if header.ID != -1 {
+	if header.ID != nil {
 		response := map[string]interface{}{
 			"jsonrpc": "2.0",
 			"id":      header.ID,
 		}
 		if handleErr != nil {
-			response["error"] = map[string]interface{}{
-				"code":    -32603,
-				"message": handleErr.Error(),
-			}
+			response["error"] = toResponseError(ctx, handleErr)
 		} else {
 			response["result"] = result
 		}
-		marsh, _ := json.Marshal(response)
-		log.Info("Sending", "resp", string(marsh))
-		s.sendResponse(response)
+		logger.Debug("Sending response", "error", handleErr)
+		s.sendResponse(ctx, response)
 	}
 
 	return handleErr
 }
 
-func (s *Server) sendResponse(response interface{}) error {
+// toResponseError picks the error code for a failed request
+func toResponseError(ctx context.Context, err error) *ResponseError {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return respErr
+	}
+	if ctx.Err() != nil || errors.Is(err, ratelimit.ErrSuperseded) {
+		return newError(RequestCancelled, "request cancelled")
+	}
+	return newError(InternalError, "%v", err)
+}
+
+// sendResponse writes a message to the connection of ctx
+func (s *Server) sendResponse(ctx context.Context, response interface{}) error {
 	responseBytes, err := json.Marshal(response)
 	if err != nil {
 		return fmt.Errorf("error marshaling response: %v", err)
@@ -141,23 +332,106 @@ func (s *Server) sendResponse(response interface{}) error {
 	message := append([]byte(header), responseBytes...)
 
 	// Write the complete message atomically
-	if _, err := s.writer.Write(message); err != nil {
+	c := s.connFrom(ctx)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.w.Write(message); err != nil {
 		return fmt.Errorf("error writing response: %v", err)
 	}
 
 	return nil
 }
 
-func (s *Server) sendCancel(id int) {
-	response := map[string]interface{}{
+// call sends a request to the client and waits for its response
+func (s *Server) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	c.nextCall++
+	id := NumberID(c.nextCall)
+	ch := make(chan Header, 1)
+	c.calls[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, id)
+		c.mu.Unlock()
+	}()
+
+	request := map[string]interface{}{
 		"jsonrpc": "2.0",
 		"id":      id,
-		"error": map[string]interface{}{
-			"code":    -32800,
-			"message": "Cancelled",
-		},
+		"method":  method,
+		"params":  params,
+	}
+	if err := s.sendResponse(ctx, request); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case resp := <-ch:
+		if resp.Error != nil {
+			return nil, fmt.Errorf("%s failed: %s", method, resp.Error.Message)
+		}
+		return resp.Result, nil
+	}
+}
+
+// notify sends a notification to the client
+func (s *Server) notify(ctx context.Context, method string, params interface{}) error {
+	return s.sendResponse(ctx, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+}
+
+// handleCallResponse hands a response over to the call of the same client
+// awaiting it. Each call takes one response, later ones are unknown.
+func (s *Server) handleCallResponse(ctx context.Context, header Header) {
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	ch, ok := c.calls[*header.ID]
+	delete(c.calls, *header.ID)
+	c.mu.Unlock()
+	if !ok {
+		log.FromContext(ctx).Warn("Response to unknown request", "id", header.ID.String())
+		return
+	}
+	ch <- header
+}
+
+// trackRequest makes the request cancellable by $/cancelRequest until done
+// is called
+func (s *Server) trackRequest(ctx context.Context, id ID) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	c.requests[id] = cancel
+	c.mu.Unlock()
+	return ctx, func() {
+		c.mu.Lock()
+		delete(c.requests, id)
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelRequest handles $/cancelRequest. The cancelled request still answers,
+// with a RequestCancelled error. Only requests of the same client can be
+// cancelled, as IDs are picked by each client.
+func (s *Server) cancelRequest(ctx context.Context, id ID) {
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	cancel, ok := c.requests[id]
+	delete(c.requests, id)
+	c.mu.Unlock()
+	if !ok {
+		log.FromContext(ctx).Debug("Nothing to cancel", "id", id.String())
+		return
 	}
-	s.sendResponse(response)
+	cancel()
+	log.FromContext(ctx).Info("Cancelled request", "id", id.String())
 }
 
 // Serve starts the LSP server on the specified address
@@ -166,82 +440,141 @@ func (s *Server) Serve(ctx context.Context, addr string) error {
 	if err != nil {
 		return fmt.Errorf("failed to start server: %v", err)
 	}
-	defer listener.Close()
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	log.Info("LSP server listening on", "port", addr, "tls", s.tlsConfig != nil)
+	return s.serveListener(ctx, listener, s.token != nil)
+}
+
+// ServeListener accepts connections until ctx is done or a client sends exit,
+// then closes the listener and every connection. Clients must authenticate
+// when a token is set.
+func (s *Server) ServeListener(ctx context.Context, listener net.Listener) error {
+	return s.serveListener(ctx, listener, s.token != nil)
+}
 
-	log.Info("LSP server listening on", "port", addr)
+func (s *Server) serveListener(ctx context.Context, listener net.Listener, needsAuth bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.exited:
+		}
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Error("Error accepting connection", "error", err)
 			continue
 		}
 
-		go s.handleConnection(ctx, conn)
+		go s.handleConnection(ctx, conn, needsAuth)
 	}
 }
 
-func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
+// ServeConn serves a single already established connection until it closes
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) {
+	s.handleConnection(ctx, conn, false)
+}
+
+// handleConnection serves conn until it closes. With needsAuth, the first
+// message must carry the token.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, needsAuth bool) {
+	// Create a connection-specific context that we can cancel
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := newConnection(conn, cancel)
+	ctx = context.WithValue(ctx, connKey{}, c)
+
 	// Add client to tracking
 	s.mu.Lock()
-	s.clients[conn] = struct{}{}
+	s.clients[conn] = c
 	s.mu.Unlock()
 
+	logger := log.With("conn", s.nextConnID.Add(1))
+	ctx = log.WithContext(ctx, logger)
+
 	// Ensure cleanup on exit
 	defer func() {
 		s.mu.Lock()
 		delete(s.clients, conn)
 		s.mu.Unlock()
 		conn.Close()
-		log.Printf("Client disconnected: %v", conn.RemoteAddr())
+		logger.Info("Client disconnected", "addr", conn.RemoteAddr())
 	}()
 
-	log.Printf("New client connected: %v", conn.RemoteAddr())
+	logger.Info("New client connected", "addr", conn.RemoteAddr())
 
-	// Create a connection-specific writer
-	connWriter := conn
 	reader := bufio.NewReader(conn)
 
-	// Create a connection-specific context that we can cancel
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
 	// Handle connection errors in a separate goroutine
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-ctx.Done():
+		case <-s.exited:
+		}
 		conn.Close()
 	}()
 
+	if needsAuth {
+		conn.SetReadDeadline(time.Now().Add(authTimeout))
+	}
+	d := s.newDispatcher(ctx)
+	defer func() {
+		// Requests still running have no one to answer to
+		cancel()
+		d.close()
+		s.closeDocuments(c)
+		c.closeConfigs()
+	}()
 	for {
 		message, err := readMessage(reader)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("Client closed connection: %v", conn.RemoteAddr())
+				logger.Info("Client closed connection")
 				return
 			}
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("Connection timeout: %v", conn.RemoteAddr())
+				logger.Info("Connection timeout")
 				return
 			}
 			if strings.Contains(err.Error(), "connection reset by peer") {
-				log.Printf("Client disconnected: %v", conn.RemoteAddr())
+				logger.Info("Connection reset")
+				return
+			}
+			if ctx.Err() != nil {
 				return
 			}
-			log.Printf("Error reading message from %v: %v", conn.RemoteAddr(), err)
+			logger.Error("Error reading message", "error", err)
 			return
 		}
 
-		// Set the writer for this specific connection
-		s.mu.Lock()
-		s.writer = connWriter
-		s.mu.Unlock()
-
-		if err := s.HandleMessage(ctx, message); err != nil {
-			log.Printf("Error handling message from %v: %v", conn.RemoteAddr(), err)
+		if needsAuth {
+			id, err := s.authenticate(message)
+			if err != nil {
+				logger.Warn("Authentication failed", "addr", conn.RemoteAddr(), "error", err)
+				s.sendError(ctx, id, newError(Unauthorized, "authentication failed"))
+				return
+			}
+			needsAuth = false
+			conn.SetReadDeadline(time.Time{})
 		}
+
+		d.dispatch(message)
 	}
 }
 
+// maxMessageSize bounds what a client, authenticated or not, can make the
+// server allocate
+const maxMessageSize = 64 << 20
+
 func readMessage(r *bufio.Reader) ([]byte, error) {
 	var contentLength int
 
@@ -265,6 +598,9 @@ func readMessage(r *bufio.Reader) ([]byte, error) {
 	if contentLength == 0 {
 		return nil, fmt.Errorf("no Content-Length header found")
 	}
+	if contentLength > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit", contentLength)
+	}
 
 	// Read exactly contentLength bytes
 	content := make([]byte, contentLength)
@@ -272,17 +608,32 @@ func readMessage(r *bufio.Reader) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read message content: %v", err)
 	}
 
-	// Verify it's valid JSON
-	if !json.Valid(content) {
-		return nil, fmt.Errorf("invalid JSON content: %s", content)
-	}
-
 	return content, nil
 }
 
 // Initialize handles the LSP initialize request
 func (s *Server) Initialize(ctx context.Context, params *InitializeParams) (*InitializeResult, error) {
-	log.Printf("Initialize request received. Root URI: %s", params.RootURI)
+	log.FromContext(ctx).Info("Initialize request received", "root", params.RootURI)
+	c := s.connFrom(ctx)
+	encoding := negotiateEncoding(params.Capabilities.General.PositionEncodings)
+	folders := params.WorkspaceFolders
+	if len(folders) == 0 && params.RootURI != "" {
+		folders = []WorkspaceFolder{{URI: params.RootURI}}
+	}
+	c.mu.Lock()
+	c.encoding = encoding
+	c.capabilities = params.Capabilities
+	c.workspaceFolders = folders
+	c.mu.Unlock()
+	c.initialized.Store(true)
+	if options, ok := parseSettings(ctx, params.InitializationOptions); ok {
+		if options.Repo == "" {
+			options.Repo = uriToPath(params.RootURI)
+		}
+		if err := c.config.Apply(ctx, options); err != nil {
+			log.FromContext(ctx).Error("Failed to apply initializationOptions", "error", err)
+		}
+	}
 
 	return &InitializeResult{
 		Info: ServerInfo{
@@ -290,70 +641,120 @@ func (s *Server) Initialize(ctx context.Context, params *InitializeParams) (*Ini
 			Version: "0.0.1",
 		},
 		Capabilities: ServerCapabilities{
+			PositionEncoding: encoding,
 			TextDocumentSync: TextDocumentSyncOptions{
 				OpenClose: true,
-				Change:    1, // Full document sync
+				Change:    2, // Incremental document sync
 				Save: SaveOptions{
 					IncludeText: true,
 				},
 			},
 			CompletionProvider: false,
+			ExecuteCommandProvider: ExecuteCommandOptions{
+				Commands: []string{RewriteCommand, CodeActionCommand},
+			},
+			CodeActionProvider: CodeActionOptions{
+				CodeActionKinds: []string{KindRewrite, KindSource},
+				ResolveProvider: true,
+			},
 		},
 	}, nil
 }
 
 // Initialized handles the LSP initialized notification
 func (s *Server) Initialized(ctx context.Context) error {
-	log.Info("Server initialized")
-	return nil
-}
-
-// Shutdown handles the LSP shutdown request
-func (s *Server) Shutdown(ctx context.Context) error {
-	log.Info("Shutdown request received")
-	return nil
-}
-
-// Exit handles the LSP exit notification
-func (s *Server) Exit(ctx context.Context) error {
-	log.Info("Exit notification received")
+	log.FromContext(ctx).Info("Server initialized")
+	if s.capabilities(ctx).Workspace.Configuration {
+		go s.pullConfiguration(ctx)
+	}
 	return nil
 }
 
 // TextDocumentDidOpen handles textDocument/didOpen notification
 func (s *Server) TextDocumentDidOpen(ctx context.Context, params *DidOpenTextDocumentParams) error {
-	log.Info("Opened:", "uri", params.TextDocument.URI)
-	s.documents[params.TextDocument.URI] = params.TextDocument.Text
-	return nil
+	doc := params.TextDocument
+	log.FromContext(ctx).Info("Opened", "uri", doc.URI)
+	snapshot := document.New(doc.URI, doc.LanguageID, doc.Version, doc.Text)
+	if !s.connFrom(ctx).opened(doc.URI) {
+		s.documents.Open(snapshot)
+		return nil
+	}
+	// Opened again without closing: counted once
+	_, err := s.documents.Update(doc.URI, func(*document.Snapshot) (*document.Snapshot, error) {
+		return snapshot, nil
+	})
+	return err
 }
 
-// TextDocumentDidChange handles textDocument/didChange notification
+// TextDocumentDidChange handles textDocument/didChange notification. Changes
+// with a range are applied in order, the others replace the whole text.
 func (s *Server) TextDocumentDidChange(ctx context.Context, params *DidChangeTextDocumentParams) error {
-	log.Info("Changed:", "uri", params.TextDocument.URI, "len",
-		len(params.ContentChanges[0].Text))
-	// For now, just store the full content
-	if len(params.ContentChanges) > 0 {
-		s.documents[params.TextDocument.URI] = params.ContentChanges[0].Text
+	encoding := s.positionEncoding(ctx)
+	snapshot, err := s.documents.Update(params.TextDocument.URI, func(doc *document.Snapshot) (*document.Snapshot, error) {
+		version := params.TextDocument.Version
+		for _, change := range params.ContentChanges {
+			if change.Range == nil {
+				doc = doc.Replace(change.Text, version)
+				continue
+			}
+			start, err := doc.Offset(change.Range.Start.Line, change.Range.Start.Character, encoding)
+			if err != nil {
+				return nil, err
+			}
+			end, err := doc.Offset(change.Range.End.Line, change.Range.End.Character, encoding)
+			if err != nil {
+				return nil, err
+			}
+			if doc, err = doc.Edit(start, end, change.Text, version); err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error applying changes: %v", err)
 	}
+	log.FromContext(ctx).Debug("Changed", "uri", snapshot.URI, "version", snapshot.Version, "changes", len(params.ContentChanges))
 	return nil
 }
 
 // TextDocumentDidSave handles textDocument/didSave notification
 func (s *Server) TextDocumentDidSave(ctx context.Context, params *DidSaveTextDocumentParams) error {
 	text := params.TextDocument.Text
-	log.Info("Saved:", "uri", params.TextDocument.URI, "len", len(text))
-	if len(text) > 0 {
-		s.documents[params.TextDocument.URI] = text
+	log.FromContext(ctx).Info("Saved", "uri", params.TextDocument.URI, "len", len(text))
+	if len(text) == 0 {
+		return nil
+	}
+	_, err := s.documents.Update(params.TextDocument.URI, func(doc *document.Snapshot) (*document.Snapshot, error) {
+		return doc.Replace(text, doc.Version), nil
+	})
+	return err
+}
+
+// TextDocumentDidClose handles textDocument/didClose notification
+func (s *Server) TextDocumentDidClose(ctx context.Context, params *DidCloseTextDocumentParams) error {
+	log.FromContext(ctx).Info("Closed", "uri", params.TextDocument.URI)
+	// Only documents the client opened count down, others may have them open
+	if s.connFrom(ctx).closed(params.TextDocument.URI) {
+		s.documents.Close(params.TextDocument.URI)
 	}
 	return nil
 }
 
+// language returns the language id the client gave a document
+func (s *Server) language(uri string) string {
+	if doc, ok := s.documents.Get(uri); ok {
+		return doc.LanguageID
+	}
+	return ""
+}
+
 type DidSaveTextDocumentParams struct {
 	TextDocument TextDocumentItem `json:"textDocument"`
 }
 
 type CancelParams struct {
-	ID int `json:"id"`
+	ID ID `json:"id"`
 }
 
 // TextDocumentCompletion handles textDocument/completion request
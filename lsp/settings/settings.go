@@ -0,0 +1,310 @@
+// Package settings loads llm_flow configuration files with named profiles.
+//
+// The global file lives at ~/.config/llm_flow/config.toml and can be
+// overridden per repository by <repo>/.llm_flow.toml. Repository files come
+// with the code, so their profiles may not set an endpoint nor read keys
+// from anywhere but the provider's own environment variable, and they may
+// not set the budget. Their limits only
+// apply where stricter than the global ones, and they may turn entropy
+// redaction on but not off:
+//
+//	profile = "default"
+//
+//	[profiles.default]
+//	provider = "codestral"
+//	model = "codestral-latest"
+//
+//	[profiles.fast]
+//	provider = "nebius"
+//	model = "Qwen/Qwen2.5-Coder-7B"
+//	endpoint = "https://api.studio.nebius.ai/v1/completions"
+//	api_key = "cmd:pass show nebius"
+//	price = { prompt = 0.02, completion = 0.06 }
+//	context_budget = 4000
+//	template = "{{.Prefix}}<|fim_suffix|>{{.Suffix}}<|fim_middle|>"
+//	max_tokens = 128
+//	temperature = 0.2
+//	stop = ["\n\n"]
+//	[profiles.fast.extra]
+//	repetition_penalty = 1.1
+//
+//	[[routes]]
+//	language = "markdown"
+//	profile = "fast"
+//
+//	[[routes]]
+//	glob = "*.yaml"
+//	profile = "fast"
+//
+//	[budget]
+//	daily_usd = 1.0
+//	fallback = "fast"
+//
+//	[limits.codestral]
+//	requests_per_second = 1
+//	burst = 2
+//	max_in_flight = 1
+//
+//	[redaction]
+//	deny = ["config/prod/*"]
+//	[redaction.patterns]
+//	internal_token = "itk_[a-z0-9]{32}"
+package settings
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/charmbracelet/log"
+	"github.com/festeh/llm_flow/lsp/credentials"
+	"github.com/festeh/llm_flow/lsp/provider"
+	"github.com/festeh/llm_flow/lsp/ratelimit"
+	"github.com/festeh/llm_flow/lsp/redact"
+	"github.com/festeh/llm_flow/lsp/usage"
+)
+
+const RepoFileName = ".llm_flow.toml"
+
+// Profile is a named provider setup
+type Profile struct {
+	Provider string `toml:"provider"`
+	Model    string `toml:"model"`
+	Endpoint string `toml:"endpoint"`
+	// ChatEndpoint receives the chat requests of rewrites and next edits
+	// when Endpoint is set, and defaults to it
+	ChatEndpoint string `toml:"chat_endpoint"`
+	// APIKey is a credentials spec such as "env:MY_KEY" or "cmd:pass show x"
+	APIKey string `toml:"api_key"`
+	// ContextBudget caps the characters of prefix and suffix sent to the model
+	ContextBudget int `toml:"context_budget"`
+	// Template overrides the prompt of providers that build a text prompt
+	Template string `toml:"template"`
+	// Price in USD per million tokens, used for cost accounting
+	Price usage.Price `toml:"price"`
+	provider.Sampling
+}
+
+// Route sends documents matching all of its non-empty conditions to a profile
+type Route struct {
+	Name string `toml:"name"`
+	// Language is matched against the LSP languageId of the document
+	Language string `toml:"language"`
+	// Glob is matched against the path relative to the repo and the base name
+	Glob string `toml:"glob"`
+	// Path matches documents under this directory
+	Path    string `toml:"path"`
+	Profile string `toml:"profile"`
+}
+
+// Matches reports whether the document at file (inside repo) is routed by r
+func (r Route) Matches(repo, file, language string) bool {
+	if r.Language != "" && !strings.EqualFold(r.Language, language) {
+		return false
+	}
+	if r.Glob != "" {
+		rel := strings.TrimPrefix(file, repo+"/")
+		matchRel, _ := filepath.Match(r.Glob, rel)
+		matchBase, _ := filepath.Match(r.Glob, filepath.Base(file))
+		if !matchRel && !matchBase {
+			return false
+		}
+	}
+	if r.Path != "" {
+		dir := expandHome(r.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repo, dir)
+		}
+		if file != dir && !strings.HasPrefix(file, strings.TrimSuffix(dir, "/")+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// DisplayName identifies the route in results and logs
+func (r Route) DisplayName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Profile
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// Settings is the merged content of the global and repository files
+type Settings struct {
+	Profile  string             `toml:"profile"`
+	Profiles map[string]Profile `toml:"profiles"`
+	// Routes are tried in order, repository routes before global ones
+	Routes    []Route        `toml:"routes"`
+	Redaction redact.Options `toml:"redaction"`
+	Budget    usage.Budget   `toml:"budget"`
+	// Limits are keyed by provider name
+	Limits map[string]ratelimit.Limits `toml:"limits"`
+}
+
+// GlobalPath returns the location of the user-wide config file
+func GlobalPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "llm_flow", "config.toml")
+}
+
+// Paths returns the config files consulted for repo, global first
+func Paths(repo string) []string {
+	paths := []string{GlobalPath()}
+	if repo != "" {
+		paths = append(paths, filepath.Join(repo, RepoFileName))
+	}
+	return paths
+}
+
+// Load reads and merges the config files for repo. Missing files are skipped;
+// profiles from later files replace same-named ones from earlier files.
+func Load(repo string) (*Settings, error) {
+	merged := &Settings{Profiles: make(map[string]Profile)}
+	for _, path := range Paths(repo) {
+		if path == "" {
+			continue
+		}
+		var s Settings
+		if _, err := toml.DecodeFile(path, &s); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading %s: %v", path, err)
+		}
+		repoFile := path != GlobalPath()
+		if repoFile {
+			if err := checkRepoFile(path, &s); err != nil {
+				return nil, err
+			}
+		}
+		if s.Profile != "" {
+			merged.Profile = s.Profile
+		}
+		for name, p := range s.Profiles {
+			merged.Profiles[name] = p
+		}
+		merged.Routes = append(s.Routes, merged.Routes...)
+		if s.Budget.IsSet() {
+			merged.Budget = s.Budget
+		}
+		for name, limits := range s.Limits {
+			if merged.Limits == nil {
+				merged.Limits = make(map[string]ratelimit.Limits)
+			}
+			if repoFile {
+				base, ok := merged.Limits[name]
+				if !ok {
+					base = ratelimit.Defaults[strings.ToLower(name)]
+				}
+				limits = base.Stricter(limits)
+			}
+			merged.Limits[name] = limits
+		}
+		merged.Redaction.Deny = append(merged.Redaction.Deny, s.Redaction.Deny...)
+		if s.Redaction.Entropy != nil && (!repoFile || *s.Redaction.Entropy) {
+			merged.Redaction.Entropy = s.Redaction.Entropy
+		}
+		for name, pattern := range s.Redaction.Patterns {
+			if merged.Redaction.Patterns == nil {
+				merged.Redaction.Patterns = make(map[string]string)
+			}
+			merged.Redaction.Patterns[name] = pattern
+		}
+	}
+	return merged, nil
+}
+
+// checkRepoFile rejects the settings of a repository file that would let
+// a checked-out repository run commands, read files or secrets from the
+// environment, redirect requests, and with them the user's key, or lift the
+// user's spending cap
+func checkRepoFile(path string, s *Settings) error {
+	if s.Budget != (usage.Budget{}) {
+		return fmt.Errorf("%s: budget may only be set in %s", path, GlobalPath())
+	}
+	for name, p := range s.Profiles {
+		if p.Endpoint != "" || p.ChatEndpoint != "" {
+			return fmt.Errorf("%s: profile %s: endpoint and chat_endpoint may only be set in %s", path, name, GlobalPath())
+		}
+		if env := provider.KeyEnvs[p.Provider]; p.APIKey != "" && !credentials.ReadsOnly(p.APIKey, env) {
+			return fmt.Errorf("%s: profile %s: api_key may only be a key: or env:%s, other sources belong in %s", path, name, env, GlobalPath())
+		}
+	}
+	return nil
+}
+
+// Get returns the named profile, or the default one when name is empty
+func (s *Settings) Get(name string) (Profile, error) {
+	if name == "" {
+		name = s.Profile
+	}
+	if name == "" {
+		return Profile{}, fmt.Errorf("no profile selected")
+	}
+	p, ok := s.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile: %s", name)
+	}
+	return p, nil
+}
+
+func modTimes(paths []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			times[path] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// Watch polls the config files for repo and calls onChange whenever one of
+// them is created, modified or removed, until ctx is done
+func Watch(ctx context.Context, repo string, interval time.Duration, onChange func()) {
+	paths := Paths(repo)
+	last := modTimes(paths)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := modTimes(paths)
+			changed := len(current) != len(last)
+			for path, t := range current {
+				if !last[path].Equal(t) {
+					changed = true
+				}
+			}
+			last = current
+			if changed {
+				log.FromContext(ctx).Info("Config file changed, reloading", "repo", repo)
+				onChange()
+			}
+		}
+	}
+}
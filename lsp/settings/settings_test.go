@@ -0,0 +1,140 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/festeh/llm_flow/lsp/ratelimit"
+)
+
+// writeFiles writes the global config and the file of a repository, and
+// returns the repository
+func writeFiles(t *testing.T, global, repo string) string {
+	t.Helper()
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	if err := os.MkdirAll(filepath.Join(config, "llm_flow"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(GlobalPath(), []byte(global), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, RepoFileName), []byte(repo), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRepoFileRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		repo string
+		// err is part of the expected error
+		err string
+	}{
+		{name: "endpoint", repo: "[profiles.p]\nprovider = \"codestral\"\nendpoint = \"http://evil\"\n", err: "endpoint"},
+		{name: "command key", repo: "[profiles.p]\nprovider = \"codestral\"\napi_key = \"cmd:cat ~/.ssh/id_rsa\"\n", err: "api_key"},
+		{name: "other env key", repo: "[profiles.p]\nprovider = \"codestral\"\napi_key = \"env:AWS_SECRET_ACCESS_KEY\"\n", err: "api_key"},
+		{name: "env key of another provider", repo: "[profiles.p]\nprovider = \"codestral\"\napi_key = \"env:CODESTRAL_API_KEY|env:NEBIUS_API_KEY\"\n", err: "api_key"},
+		{name: "budget", repo: "[budget]\ndaily_usd = 1e9\n", err: "budget"},
+		{name: "budget fallback", repo: "[budget]\nfallback = \"p\"\n", err: "budget"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := writeFiles(t, "[budget]\ndaily_usd = 1.0\n", tt.repo)
+			_, err := Load(repo)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want an error about %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRepoLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		global string
+		repo   string
+		want   ratelimit.Limits
+	}{
+		{
+			name:   "looser",
+			global: "[limits.nebius]\nrequests_per_second = 2\nburst = 2\nmax_in_flight = 1\n",
+			repo:   "[limits.nebius]\nrequests_per_second = 100\nburst = 50\nmax_in_flight = 10\n",
+			want:   ratelimit.Limits{RequestsPerSecond: 2, Burst: 2, MaxInFlight: 1},
+		},
+		{
+			name:   "stricter",
+			global: "[limits.nebius]\nrequests_per_second = 2\nburst = 2\n",
+			repo:   "[limits.nebius]\nrequests_per_second = 0.5\nburst = 1\nmax_in_flight = 1\n",
+			want:   ratelimit.Limits{RequestsPerSecond: 0.5, Burst: 1, MaxInFlight: 1},
+		},
+		{
+			name: "defaults",
+			repo: "[limits.codestral]\nrequests_per_second = 100\nburst = 50\nmax_in_flight = 10\n",
+			want: ratelimit.Defaults["codestral"],
+		},
+		{
+			name: "unlimited",
+			repo: "[limits.nebius]\nmax_in_flight = 2\n",
+			want: ratelimit.Limits{MaxInFlight: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Load(writeFiles(t, tt.global, tt.repo))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s.Limits) != 1 {
+				t.Fatalf("got limits %+v", s.Limits)
+			}
+			for name, got := range s.Limits {
+				if got != tt.want {
+					t.Errorf("%s: got %+v, want %+v", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRepoEntropy(t *testing.T) {
+	tests := []struct {
+		name   string
+		global string
+		repo   string
+		want   *bool
+	}{
+		{name: "disabled by repo", repo: "[redaction]\nentropy = false\n", want: nil},
+		{name: "enabled by repo", global: "[redaction]\nentropy = false\n", repo: "[redaction]\nentropy = true\n", want: ptr(true)},
+		{name: "disabled globally", global: "[redaction]\nentropy = false\n", want: ptr(false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Load(writeFiles(t, tt.global, tt.repo))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Redaction.Entropy
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("got entropy %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRepoKeys(t *testing.T) {
+	for _, key := range []string{"env:CODESTRAL_API_KEY", "key:abc|def"} {
+		repo := writeFiles(t, "", "[profiles.p]\nprovider = \"codestral\"\napi_key = \""+key+"\"\n")
+		if _, err := Load(repo); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+)
+
+// DefaultSocketPath is the per-user socket of the shared daemon
+func DefaultSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "llm_flow-"+strconv.Itoa(os.Getuid()))
+	} else {
+		dir = filepath.Join(dir, "llm_flow")
+	}
+	return filepath.Join(dir, "llm_flow.sock")
+}
+
+// ListenUnix listens on a Unix socket only the current user can connect to.
+// A stale socket left by a dead server is replaced, a live one is an error.
+func ListenUnix(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating socket directory: %v", err)
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a server is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing stale socket: %v", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error restricting socket: %v", err)
+	}
+	return listener, nil
+}
+
+// DialUnix connects to the daemon on the socket at path, once it checked that
+// the current user owns the socket and its directory. Another user could
+// otherwise listen there, e.g. in a directory pre-created under /tmp, and
+// receive the editor's documents.
+func DialUnix(path string) (net.Conn, error) {
+	if err := checkSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s is not a socket", path)
+	}
+	if err := checkOwner(path, info); err != nil {
+		return nil, err
+	}
+	return net.Dial("unix", path)
+}
+
+// checkSocketDir makes sure only the current user can reach sockets in dir
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("error checking socket directory: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if err := checkOwner(dir, info); err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("socket directory %s is accessible by other users", dir)
+	}
+	return nil
+}
+
+func checkOwner(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot tell the owner of %s", path)
+	}
+	if int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user (uid %d)", path, stat.Uid)
+	}
+	return nil
+}
+
+// ServeUnix serves on the Unix socket at path until ctx is done or exit
+func (s *Server) ServeUnix(ctx context.Context, path string) error {
+	listener, err := ListenUnix(path)
+	if err != nil {
+		return err
+	}
+	log.Info("LSP server listening on", "socket", path)
+	// File permissions keep other users out
+	return s.serveListener(ctx, listener, false)
+}
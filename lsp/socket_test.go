@@ -0,0 +1,43 @@
+package lsp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialUnix(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "llm_flow")
+	path := filepath.Join(dir, "llm_flow.sock")
+	listener, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := DialUnix(path)
+	if err != nil {
+		t.Fatalf("dial own socket: %v", err)
+	}
+	conn.Close()
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialUnix(path); err == nil {
+		t.Error("dialed a socket in a directory other users can reach")
+	}
+	os.Chmod(dir, 0700)
+
+	if os.Getuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	if err := os.Chown(dir, os.Getuid()+1, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialUnix(path); err == nil {
+		t.Error("dialed a socket in a directory of another user")
+	}
+	if _, err := ListenUnix(filepath.Join(dir, "other.sock")); err == nil {
+		t.Error("listened in a directory of another user")
+	}
+}
@@ -3,6 +3,7 @@ package splitter
 import (
 	"github.com/charmbracelet/log"
 	"github.com/festeh/llm_flow/lsp/constants"
+	"path/filepath"
 	"strings"
 )
 
@@ -11,10 +12,15 @@ type Splitter int
 type SplitFn func(*map[string]interface{}) error
 
 type ProjectContext struct {
-  Repo string
-	File   string
-	Prefix string
-	Suffix string
+	Repo   string `json:"repo"`
+	File   string `json:"file"`
+	Prefix string `json:"prefix"`
+	Suffix string `json:"suffix"`
+	// Edits describes the recent changes to the file, for next-edit
+	// prediction
+	Edits string `json:"edits,omitempty"`
+	// Selection is the code between Prefix and Suffix a rewrite replaces
+	Selection string `json:"selection,omitempty"`
 }
 
 const (
@@ -44,11 +50,48 @@ func GetFimNaiveSplitter(text string) SplitFn {
 		prefix = parts[0]
 		suffix = parts[1]
 	}
-	log.Debug("", "prefix", prefix)
-	log.Debug("", "suffix", suffix)
 	return func(data *map[string]interface{}) error {
 		(*data)["prompt"] = prefix
 		(*data)["suffix"] = suffix
 		return nil
 	}
 }
+
+// RepoName is the base name of the repository directory
+func (c ProjectContext) RepoName() string {
+	return filepath.Base(c.Repo)
+}
+
+// RelativeFile is the file path relative to the repository root
+func (c ProjectContext) RelativeFile() string {
+	return strings.TrimPrefix(c.File, c.Repo+"/")
+}
+
+// Trim keeps at most budget characters of context, three quarters of it for
+// the prefix, cutting at line boundaries where possible. A budget <= 0 means
+// no limit.
+func (c ProjectContext) Trim(budget int) ProjectContext {
+	if budget <= 0 || len(c.Prefix)+len(c.Suffix) <= budget {
+		return c
+	}
+	suffixBudget := budget / 4
+	if len(c.Suffix) < suffixBudget {
+		suffixBudget = len(c.Suffix)
+	}
+	prefixBudget := budget - suffixBudget
+	if len(c.Prefix) > prefixBudget {
+		prefix := c.Prefix[len(c.Prefix)-prefixBudget:]
+		if i := strings.IndexByte(prefix, '\n'); i >= 0 && i < len(prefix)-1 {
+			prefix = prefix[i+1:]
+		}
+		c.Prefix = prefix
+	}
+	if len(c.Suffix) > suffixBudget {
+		suffix := c.Suffix[:suffixBudget]
+		if i := strings.LastIndexByte(suffix, '\n'); i > 0 {
+			suffix = suffix[:i]
+		}
+		c.Suffix = suffix
+	}
+	return c
+}
@@ -0,0 +1,169 @@
+package telemetry
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event kinds recorded in the store
+const (
+	Predicted = "predicted"
+	Shown     = "shown"
+	Accepted  = "accepted"
+	Rejected  = "rejected"
+)
+
+// Event is a single line of the telemetry log
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// ID of the predict_editor request, a JSON number or string
+	ID             json.RawMessage `json:"id"`
+	Provider       string          `json:"provider"`
+	Model          string          `json:"model"`
+	Language       string          `json:"language,omitempty"`
+	LatencyMs      int64           `json:"latency_ms"`
+	Length         int             `json:"length"`
+	AcceptedLength int             `json:"accepted_length,omitempty"`
+}
+
+// Store appends events to a local JSONL file
+type Store struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// DefaultPath returns the telemetry file location under the user data dir
+func DefaultPath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "llm_flow", "telemetry.jsonl")
+}
+
+// Open opens (or creates) the telemetry file at path for appending
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating telemetry dir: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening telemetry file: %v", err)
+	}
+	return &Store{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends an event. A nil store silently drops it.
+func (s *Store) Record(e Event) error {
+	if s == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(e)
+}
+
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Summary aggregates outcomes for one provider/model pair
+type Summary struct {
+	Provider       string
+	Model          string
+	Predictions    int
+	Shown          int
+	Accepted       int
+	Partial        int
+	Rejected       int
+	TotalLatencyMs int64
+}
+
+// AcceptanceRate is the share of resolved predictions that were at least
+// partially accepted
+func (s Summary) AcceptanceRate() float64 {
+	resolved := s.Accepted + s.Partial + s.Rejected
+	if resolved == 0 {
+		return 0
+	}
+	return float64(s.Accepted+s.Partial) / float64(resolved)
+}
+
+func (s Summary) AvgLatency() time.Duration {
+	if s.Predictions == 0 {
+		return 0
+	}
+	return time.Duration(s.TotalLatencyMs/int64(s.Predictions)) * time.Millisecond
+}
+
+// Summarize reads a telemetry log and aggregates it per provider and model
+func Summarize(r io.Reader) ([]Summary, error) {
+	byKey := make(map[string]*Summary)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error parsing telemetry event: %v", err)
+		}
+		key := e.Provider + "/" + e.Model
+		s, ok := byKey[key]
+		if !ok {
+			s = &Summary{Provider: e.Provider, Model: e.Model}
+			byKey[key] = s
+		}
+		switch e.Kind {
+		case Predicted:
+			s.Predictions++
+			s.TotalLatencyMs += e.LatencyMs
+		case Shown:
+			s.Shown++
+		case Accepted:
+			if e.AcceptedLength > 0 && e.AcceptedLength < e.Length {
+				s.Partial++
+			} else {
+				s.Accepted++
+			}
+		case Rejected:
+			s.Rejected++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	summaries := make([]Summary, 0, len(byKey))
+	for _, s := range byKey {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Provider != summaries[j].Provider {
+			return summaries[i].Provider < summaries[j].Provider
+		}
+		return summaries[i].Model < summaries[j].Model
+	})
+	return summaries, nil
+}
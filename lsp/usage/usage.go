@@ -0,0 +1,304 @@
+// Package usage accounts tokens and cost of provider requests and enforces
+// budgets on them.
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const dayLayout = "2006-01-02"
+
+// Tokens consumed by one request
+type Tokens struct {
+	Prompt     int `json:"prompt_tokens"`
+	Completion int `json:"completion_tokens"`
+	// Estimated is set when the provider did not report usage
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+func (t Tokens) Total() int {
+	return t.Prompt + t.Completion
+}
+
+// Price is the USD cost per million tokens
+type Price struct {
+	Prompt     float64 `toml:"prompt" json:"prompt"`
+	Completion float64 `toml:"completion" json:"completion"`
+}
+
+func (p Price) Cost(t Tokens) float64 {
+	return (float64(t.Prompt)*p.Prompt + float64(t.Completion)*p.Completion) / 1e6
+}
+
+// Budget caps spending. Zero fields are unlimited.
+type Budget struct {
+	DailyTokens   int     `toml:"daily_tokens" json:"daily_tokens,omitempty"`
+	MonthlyTokens int     `toml:"monthly_tokens" json:"monthly_tokens,omitempty"`
+	DailyUSD      float64 `toml:"daily_usd" json:"daily_usd,omitempty"`
+	MonthlyUSD    float64 `toml:"monthly_usd" json:"monthly_usd,omitempty"`
+	// Fallback is the profile used once the budget is exceeded; empty pauses
+	// completions instead
+	Fallback string `toml:"fallback" json:"fallback,omitempty"`
+}
+
+func (b Budget) IsSet() bool {
+	return b.DailyTokens > 0 || b.MonthlyTokens > 0 || b.DailyUSD > 0 || b.MonthlyUSD > 0
+}
+
+// Record aggregates usage of one provider/model/repo on one day
+type Record struct {
+	Day              string  `json:"day"`
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	Repo             string  `json:"repo"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	EstimatedTokens  int     `json:"estimated_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// Totals sums usage over a period
+type Totals struct {
+	Requests int     `json:"requests"`
+	Tokens   int     `json:"tokens"`
+	CostUSD  float64 `json:"cost_usd"`
+}
+
+// Store keeps usage records, persisted to a JSON file when it has a path.
+// The servers of several editors may share the file: changes are merged into
+// it under a file lock, and reads pick up the changes of the others.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]*Record
+	// file is the file as the records were last read or written. Each write
+	// replaces the file, so that a change of file or of time tells a write.
+	file os.FileInfo
+	now  func() time.Time
+}
+
+// DefaultPath returns the usage file location under the user data dir
+func DefaultPath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "llm_flow", "usage.json")
+}
+
+// NewMemoryStore creates a store that is not persisted
+func NewMemoryStore() *Store {
+	return &Store{records: make(map[string]*Record), now: time.Now}
+}
+
+// Open loads the store at path, creating it on first write
+func Open(path string) (*Store, error) {
+	s := NewMemoryStore()
+	s.path = path
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the records from the file if it changed since they were last
+// read or written
+func (s *Store) reload() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading usage file: %v", err)
+	}
+	if s.file != nil && os.SameFile(s.file, info) && info.ModTime().Equal(s.file.ModTime()) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("error reading usage file: %v", err)
+	}
+	var records []*Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("error parsing usage file: %v", err)
+	}
+	s.records = make(map[string]*Record, len(records))
+	for _, r := range records {
+		s.records[key(r.Day, r.Provider, r.Model, r.Repo)] = r
+	}
+	s.file = info
+	return nil
+}
+
+// lock takes the lock file next to the usage file, which orders the changes
+// of the processes sharing it
+func (s *Store) lock() (func(), error) {
+	if s.path == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening usage lock: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking usage file: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func key(day, provider, model, repo string) string {
+	return day + "\x00" + provider + "\x00" + model + "\x00" + repo
+}
+
+// Add accounts one request and returns its cost. The request is accounted
+// in memory even if the file cannot be updated.
+func (s *Store) Add(provider, model, repo string, tokens Tokens, price Price) (float64, error) {
+	cost := price.Cost(tokens)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err == nil {
+		defer unlock()
+		err = s.reload()
+	}
+	day := s.now().Format(dayLayout)
+	k := key(day, provider, model, repo)
+	r, ok := s.records[k]
+	if !ok {
+		r = &Record{Day: day, Provider: provider, Model: model, Repo: repo}
+		s.records[k] = r
+	}
+	r.Requests++
+	r.PromptTokens += tokens.Prompt
+	r.CompletionTokens += tokens.Completion
+	if tokens.Estimated {
+		r.EstimatedTokens += tokens.Total()
+	}
+	r.CostUSD += cost
+	if err != nil {
+		return cost, err
+	}
+	return cost, s.save()
+}
+
+func (s *Store) sorted() []Record {
+	records := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return key("", a.Provider, a.Model, a.Repo) < key("", b.Provider, b.Model, b.Repo)
+	})
+	return records
+}
+
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.file = info
+	}
+	return nil
+}
+
+// Records returns all records from day since on (all when since is empty)
+func (s *Store) Records(since string) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Failing to read the changes of other processes leaves the last known ones
+	s.reload()
+	var out []Record
+	for _, r := range s.sorted() {
+		if r.Day >= since {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (s *Store) totalsSince(day string) Totals {
+	var t Totals
+	for _, r := range s.records {
+		if r.Day >= day {
+			t.Requests += r.Requests
+			t.Tokens += r.PromptTokens + r.CompletionTokens
+			t.CostUSD += r.CostUSD
+		}
+	}
+	return t
+}
+
+// Today and Month return totals of the current day and calendar month
+func (s *Store) Today() Totals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	return s.totalsSince(s.now().Format(dayLayout))
+}
+
+func (s *Store) Month() Totals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	return s.totalsSince(s.now().Format("2006-01") + "-01")
+}
+
+// Exceeded reports which limit of b, if any, is used up
+func (s *Store) Exceeded(b Budget) (string, bool) {
+	if !b.IsSet() {
+		return "", false
+	}
+	today, month := s.Today(), s.Month()
+	switch {
+	case b.DailyTokens > 0 && today.Tokens >= b.DailyTokens:
+		return "daily token budget", true
+	case b.MonthlyTokens > 0 && month.Tokens >= b.MonthlyTokens:
+		return "monthly token budget", true
+	case b.DailyUSD > 0 && today.CostUSD >= b.DailyUSD:
+		return "daily cost budget", true
+	case b.MonthlyUSD > 0 && month.CostUSD >= b.MonthlyUSD:
+		return "monthly cost budget", true
+	}
+	return "", false
+}
@@ -0,0 +1,35 @@
+package usage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	a, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := Tokens{Prompt: 10, Completion: 5}
+	if _, err := a.Add("mock", "m", "repo", tokens, Price{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add("mock", "m", "repo", tokens, Price{}); err != nil {
+		t.Fatal(err)
+	}
+	if today := a.Today(); today.Requests != 2 || today.Tokens != 30 {
+		t.Errorf("got %+v, want the requests of both stores", today)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := reopened.Records(""); len(records) != 1 || records[0].Requests != 2 {
+		t.Errorf("got %+v, want one record of 2 requests", records)
+	}
+}
@@ -0,0 +1,159 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+)
+
+// wsConn carries one JSON-RPC message per WebSocket text message, as browser
+// LSP clients do, and adapts it to the Content-Length framing of the server
+type wsConn struct {
+	ws      *websocket.Conn
+	pending bytes.Buffer
+	writeMu sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.pending.Len() == 0 {
+		kind, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if kind != websocket.TextMessage && kind != websocket.BinaryMessage {
+			continue
+		}
+		fmt.Fprintf(&c.pending, "Content-Length: %d\r\n\r\n", len(data))
+		c.pending.Write(data)
+	}
+	return c.pending.Read(p)
+}
+
+// Write strips the framing and sends every complete message
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.written.Write(p)
+	for {
+		unread := bytes.NewReader(c.written.Bytes())
+		r := bufio.NewReader(unread)
+		message, err := readMessage(r)
+		if err != nil {
+			// Wait for the rest of the message
+			return len(p), nil
+		}
+		c.written.Next(c.written.Len() - unread.Len() - r.Buffered())
+		if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.ws.RemoteAddr() }
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.ws.NetConn().SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// requestToken takes the token from an Authorization: Bearer header, or from
+// the token query parameter for browsers, which cannot set headers
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// SetAllowedOrigins lets browser pages served from origins, e.g.
+// "https://editor.example.com", open WebSocket connections. "*" allows any
+// origin. Same-origin pages and clients that send no Origin are always
+// allowed.
+func (s *Server) SetAllowedOrigins(origins []string) {
+	s.allowedOrigins = origins
+}
+
+// checkOrigin keeps web pages of other origins from driving the server
+// through the user's browser
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.allowedOrigins {
+		allowed = strings.TrimSuffix(strings.TrimSpace(allowed), "/")
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeWebSocket accepts LSP clients over WebSocket on addr until ctx is done
+// or exit. With a token set, clients authenticate during the upgrade or, like
+// TCP clients, in their initialize request.
+func (s *Server) ServeWebSocket(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handler := s.webSocketHandler(ctx)
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: s.tlsConfig}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.exited:
+		}
+		server.Close()
+	}()
+	log.Info("LSP server listening on", "websocket", addr, "tls", s.tlsConfig != nil)
+	var err error
+	if s.tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// webSocketHandler upgrades requests to LSP connections served until ctx is
+// done
+func (s *Server) webSocketHandler(ctx context.Context) http.Handler {
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated := s.token == nil
+		if token := requestToken(r); token != "" {
+			if err := s.checkToken(token); err != nil {
+				log.Warn("WebSocket authentication failed", "addr", r.RemoteAddr, "error", err)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			authenticated = true
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Error("WebSocket upgrade failed", "addr", r.RemoteAddr, "error", err)
+			return
+		}
+		s.handleConnection(ctx, &wsConn{ws: ws}, !authenticated)
+	})
+}
@@ -0,0 +1,77 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWebSocket(t *testing.T, s *Server, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv := httptest.NewServer(s.webSocketHandler(ctx))
+	t.Cleanup(srv.Close)
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{name: "no origin", ok: true},
+		{name: "other origin", origin: "https://evil.example.com"},
+		{name: "allowed origin", origin: "https://editor.example.com", allowed: []string{"https://editor.example.com/"}, ok: true},
+		{name: "any origin", origin: "https://editor.example.com", allowed: []string{"*"}, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(io.Discard)
+			s.SetAllowedOrigins(tt.allowed)
+			ws, resp, err := dialWebSocket(t, s, tt.origin)
+			if !tt.ok {
+				if err == nil {
+					ws.Close()
+					t.Fatal("upgrade succeeded")
+				}
+				if resp == nil || resp.StatusCode != http.StatusForbidden {
+					t.Fatalf("got %v, want 403", resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer ws.Close()
+			request := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{}}}`
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+				t.Fatal(err)
+			}
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var response struct {
+				ID     int             `json:"id"`
+				Result json.RawMessage `json:"result"`
+			}
+			if err := json.Unmarshal(data, &response); err != nil || response.ID != 1 || response.Result == nil {
+				t.Fatalf("unexpected response %s", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Section of the client settings holding llm_flow configuration
+const settingsSection = "llm_flow"
+
+const configurationTimeout = 10 * time.Second
+
+// uriToPath converts a file URI to a path, decoding escapes such as %20
+func uriToPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	path := strings.TrimPrefix(uri, "file://")
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		return unescaped
+	}
+	return path
+}
+
+// parseSettings reads SetConfigParams either from an "llm_flow" section or
+// from the top level of raw. ok is false when raw configures nothing.
+func parseSettings(ctx context.Context, raw json.RawMessage) (params SetConfigParams, ok bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return params, false
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &sections); err != nil {
+		log.FromContext(ctx).Error("Invalid settings", "error", err)
+		return params, false
+	}
+	if section, found := sections[settingsSection]; found {
+		raw = section
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		log.FromContext(ctx).Error("Invalid settings", "error", err)
+		return params, false
+	}
+	return params, params.Provider != "" || params.Profile != ""
+}
+
+// defaultRepo is the repo used when the settings of the client of ctx don't
+// name one
+func (s *Server) defaultRepo(ctx context.Context) string {
+	c := s.connFrom(ctx)
+	c.config.mu.Lock()
+	repo := c.config.Repo
+	c.config.mu.Unlock()
+	if repo != "" {
+		return repo
+	}
+	if folders := c.folders(); len(folders) > 0 {
+		return uriToPath(folders[0].URI)
+	}
+	return ""
+}
+
+// WorkspaceDidChangeConfiguration handles workspace/didChangeConfiguration
+func (s *Server) WorkspaceDidChangeConfiguration(ctx context.Context, params *DidChangeConfigurationParams) error {
+	log.FromContext(ctx).Info("Configuration changed")
+	if s.capabilities(ctx).Workspace.Configuration {
+		go s.pullConfiguration(ctx)
+	}
+	options, ok := parseSettings(ctx, params.Settings)
+	if !ok {
+		return nil
+	}
+	if options.Repo == "" {
+		options.Repo = s.defaultRepo(ctx)
+	}
+	return s.connFrom(ctx).config.Apply(ctx, options)
+}
+
+// pullConfiguration asks the client for the global settings and the
+// settings of every workspace folder
+func (s *Server) pullConfiguration(ctx context.Context) {
+	folders := s.connFrom(ctx).folders()
+	items := []ConfigurationItem{{Section: settingsSection}}
+	for _, folder := range folders {
+		items = append(items, ConfigurationItem{ScopeURI: folder.URI, Section: settingsSection})
+	}
+	ctx, cancel := context.WithTimeout(ctx, configurationTimeout)
+	defer cancel()
+	raw, err := s.call(ctx, "workspace/configuration", ConfigurationParams{Items: items})
+	if err != nil {
+		log.FromContext(ctx).Error("Failed to pull configuration", "error", err)
+		return
+	}
+	var results []json.RawMessage
+	if err := json.Unmarshal(raw, &results); err != nil || len(results) != len(items) {
+		log.FromContext(ctx).Error("Invalid workspace/configuration response", "error", err, "items", len(results))
+		return
+	}
+
+	if options, ok := parseSettings(ctx, results[0]); ok {
+		if options.Repo == "" {
+			options.Repo = s.defaultRepo(ctx)
+		}
+		if err := s.connFrom(ctx).config.Apply(ctx, options); err != nil {
+			log.FromContext(ctx).Error("Failed to apply configuration", "error", err)
+		}
+	}
+	for i, folder := range folders {
+		if err := s.applyFolderSettings(ctx, uriToPath(folder.URI), results[i+1]); err != nil {
+			log.FromContext(ctx).Error("Failed to apply folder configuration", "folder", folder.URI, "error", err)
+		}
+	}
+}
+
+func (s *Server) applyFolderSettings(ctx context.Context, folder string, raw json.RawMessage) error {
+	options, ok := parseSettings(ctx, raw)
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	cfg, exists := c.folderConfigs[folder]
+	if !ok {
+		delete(c.folderConfigs, folder)
+	} else if !exists {
+		cfg = &Config{}
+		c.folderConfigs[folder] = cfg
+	}
+	c.mu.Unlock()
+	if !ok {
+		if exists {
+			cfg.Close()
+		}
+		return nil
+	}
+	if options.Repo == "" {
+		options.Repo = folder
+	}
+	if err := cfg.Apply(ctx, options); err != nil {
+		return fmt.Errorf("error applying settings: %v", err)
+	}
+	return nil
+}
+
+// configFor returns the config of the innermost workspace folder of the
+// client of ctx containing uri, falling back to the client's global config
+func (s *Server) configFor(ctx context.Context, uri string) *Config {
+	path := uriToPath(uri)
+	c := s.connFrom(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	best, bestLen := c.config, -1
+	for folder, cfg := range c.folderConfigs {
+		if !cfg.configured() || len(folder) <= bestLen {
+			continue
+		}
+		if path == folder || strings.HasPrefix(path, folder+"/") {
+			best, bestLen = cfg, len(folder)
+		}
+	}
+	return best
+}
+
+// routeFor picks the provider for the document at uri, taking budgets into
+// account
+func (s *Server) routeFor(ctx context.Context, uri string) (Route, error) {
+	cfg := s.configFor(ctx, uri)
+	return cfg.withinBudget(ctx, s.usage, cfg.Route(uriToPath(uri), s.language(uri)))
+}